@@ -0,0 +1,230 @@
+package viewproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// HeaderMerger builds the response headers of a page from its fragment
+// results, keyed by fragment key. In streaming mode only the root result is
+// available.
+type HeaderMerger func(route *Route, results map[string]*multiplexer.Result) http.Header
+
+// Headers that describe the body of a single response, so they are only taken
+// from the root fragment.
+var rootOnlyHeaders = []string{
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"Etag",
+	"Last-Modified",
+	"Location",
+}
+
+// DefaultHeaderMerger merges the headers of every fragment that doesn't ignore
+// its headers:
+//
+//   - Root headers take precedence over child fragment headers.
+//   - Content-Type and other headers describing the body come from the root.
+//   - Set-Cookie headers are aggregated from all fragments.
+//   - Cache-Control is the most restrictive of all fragments.
+//   - Vary is the union of all fragments.
+func DefaultHeaderMerger(route *Route, results map[string]*multiplexer.Result) http.Header {
+	headers := make(http.Header)
+	cacheControls := make([]string, 0)
+	vary := make([]string, 0)
+	cookies := make([]string, 0)
+
+	fragments := route.FragmentsToRequest()
+
+	for i, key := range route.FragmentOrder() {
+		result, ok := results[key]
+		if !ok || fragments[i].IgnoreHeaders {
+			continue
+		}
+
+		resultHeaders := result.HeadersWithoutProxyHeaders()
+		cacheControls = append(cacheControls, resultHeaders.Values("Cache-Control")...)
+		vary = append(vary, resultHeaders.Values("Vary")...)
+		cookies = append(cookies, resultHeaders.Values("Set-Cookie")...)
+
+		for _, name := range []string{"Cache-Control", "Vary", "Set-Cookie"} {
+			resultHeaders.Del(name)
+		}
+
+		if key != "root" {
+			for _, name := range rootOnlyHeaders {
+				resultHeaders.Del(name)
+			}
+		}
+
+		for name, values := range resultHeaders {
+			if _, ok := headers[name]; !ok {
+				headers[name] = values
+			}
+		}
+	}
+
+	if root, ok := results["root"]; ok {
+		if contentType := root.Header().Get("Content-Type"); contentType != "" {
+			headers.Set("Content-Type", contentType)
+		}
+	}
+
+	if cacheControl := mostRestrictiveCacheControl(cacheControls); cacheControl != "" {
+		headers.Set("Cache-Control", cacheControl)
+	}
+
+	if varyUnion := unionHeaderValues(vary); varyUnion != "" {
+		headers.Set("Vary", varyUnion)
+	}
+
+	for _, cookie := range cookies {
+		headers.Add("Set-Cookie", cookie)
+	}
+
+	headers.Del("Content-Length")
+
+	return headers
+}
+
+// mostRestrictiveCacheControl combines Cache-Control headers so that the result
+// is cacheable for no longer, and by no more caches, than each of them.
+func mostRestrictiveCacheControl(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	allPublic := true
+	var private, noCache, mustRevalidate bool
+	maxAge, sMaxAge := -1, -1
+
+	for _, value := range values {
+		directives := parseDirectives(value)
+
+		if _, ok := directives["no-store"]; ok {
+			return "no-store"
+		}
+
+		_, public := directives["public"]
+		allPublic = allPublic && public
+
+		if _, ok := directives["private"]; ok {
+			private = true
+		}
+		if _, ok := directives["no-cache"]; ok {
+			noCache = true
+		}
+		if _, ok := directives["must-revalidate"]; ok {
+			mustRevalidate = true
+		}
+
+		maxAge = minDirective(maxAge, directives["max-age"])
+		sMaxAge = minDirective(sMaxAge, directives["s-maxage"])
+	}
+
+	combined := make([]string, 0)
+
+	if private {
+		combined = append(combined, "private")
+	} else if allPublic {
+		combined = append(combined, "public")
+	}
+
+	if noCache {
+		combined = append(combined, "no-cache")
+	}
+
+	if maxAge >= 0 {
+		combined = append(combined, "max-age="+strconv.Itoa(maxAge))
+	}
+
+	if sMaxAge >= 0 && !private {
+		combined = append(combined, "s-maxage="+strconv.Itoa(sMaxAge))
+	}
+
+	if mustRevalidate {
+		combined = append(combined, "must-revalidate")
+	}
+
+	return strings.Join(combined, ", ")
+}
+
+func parseDirectives(value string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, directive := range strings.Split(value, ",") {
+		name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+		}
+	}
+
+	return directives
+}
+
+// minDirective returns the smaller of current and value, where a negative
+// current means no value has been seen yet.
+func minDirective(current int, value string) int {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return current
+	}
+
+	if current < 0 || seconds < current {
+		return seconds
+	}
+
+	return current
+}
+
+// unionHeaderValues combines comma separated header values, removing
+// duplicates.
+func unionHeaderValues(values []string) string {
+	seen := make(map[string]struct{})
+	union := make([]string, 0)
+
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			canonical := http.CanonicalHeaderKey(name)
+
+			if name == "" {
+				continue
+			}
+
+			if name == "*" {
+				return "*"
+			}
+
+			if _, ok := seen[canonical]; !ok {
+				seen[canonical] = struct{}{}
+				union = append(union, canonical)
+			}
+		}
+	}
+
+	return strings.Join(union, ", ")
+}
+
+func withMergedHeaders(s *Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		route := RouteFromContext(r.Context())
+		results := multiplexer.ResultsFromContext(r.Context())
+
+		if route != nil && results != nil && len(results.Results()) > 0 {
+			headers := s.MergeHeaders(route, mapResultsToFragmentKey(route, results.Results()))
+
+			for name, values := range headers {
+				for _, value := range values {
+					rw.Header().Add(name, value)
+				}
+			}
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
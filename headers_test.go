@@ -0,0 +1,105 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergesFragmentHeaders(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/layout":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Name", "layout")
+			w.Header().Set("Cache-Control", "public, max-age=300")
+			w.Header().Set("Vary", "Accept-Encoding")
+			w.Header().Add("Set-Cookie", "layout=1")
+			w.Write([]byte(`<html><viewproxy-fragment id="header"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case strings.HasPrefix(r.URL.Path, "/header/"):
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Name", "header")
+			w.Header().Set("X-Header", "header")
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			w.Header().Set("Vary", "cookie, accept-encoding")
+			w.Header().Add("Set-Cookie", "header=1")
+			w.Write([]byte("<body>"))
+		case strings.HasPrefix(r.URL.Path, "/body/"):
+			w.Header().Set("X-Body", "body")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Add("Set-Cookie", "body=1")
+			w.Write([]byte("hello</body>"))
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	root := fragment.Define(
+		"/layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name", fragment.WithoutHeaders())),
+	)
+	err := server.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, "layout", resp.Header.Get("X-Name"))
+	require.Equal(t, "header", resp.Header.Get("X-Header"))
+	require.Equal(t, "", resp.Header.Get("X-Body"))
+	require.Equal(t, "private, max-age=60", resp.Header.Get("Cache-Control"))
+	require.Equal(t, "Accept-Encoding, Cookie", resp.Header.Get("Vary"))
+	require.Equal(t, []string{"layout=1", "header=1"}, resp.Header.Values("Set-Cookie"))
+}
+
+func TestMergeHeadersIsConfigurable(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.MergeHeaders = func(route *Route, results map[string]*multiplexer.Result) http.Header {
+		return http.Header{"X-Merged": []string{route.Path}}
+	}
+
+	err := server.Get("/hello/:name", fragment.Define("/header/:name"))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	require.Equal(t, "/hello/:name", resp.Header.Get("X-Merged"))
+	require.Equal(t, "", resp.Header.Get("X-Name"))
+}
+
+func TestMostRestrictiveCacheControl(t *testing.T) {
+	tests := map[string]struct {
+		values []string
+		want   string
+	}{
+		"none":                     {values: []string{}, want: ""},
+		"single":                   {values: []string{"public, max-age=60"}, want: "public, max-age=60"},
+		"no-store wins":            {values: []string{"public, max-age=60", "no-store"}, want: "no-store"},
+		"shortest max-age":         {values: []string{"max-age=60", "max-age=30"}, want: "max-age=30"},
+		"private wins over public": {values: []string{"public, s-maxage=60", "private, max-age=30"}, want: "private, max-age=30"},
+		"public requires all":      {values: []string{"public, max-age=60", "max-age=60"}, want: "max-age=60"},
+		"no-cache":                 {values: []string{"public, max-age=60", "no-cache, must-revalidate"}, want: "no-cache, max-age=60, must-revalidate"},
+		"shortest s-maxage":        {values: []string{"public, s-maxage=60", "public, s-maxage=120"}, want: "public, s-maxage=60"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.want, mostRestrictiveCacheControl(test.values))
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// newReverseProxy returns a reverse proxy for pass through requests that makes
+// requests using the server's MultiplexerTripper, so that trippers used for
+// logging, metrics or authentication also apply to pass through requests.
+func (s *Server) newReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &tripperTransport{server: s}
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if s.PassThroughModifyResponse != nil {
+			return s.PassThroughModifyResponse(resp)
+		}
+
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if s.PassThroughErrorHandler != nil {
+			s.PassThroughErrorHandler(w, r, err)
+			return
+		}
+
+		s.Logger.Printf("Could not proxy %s: %s", s.SecretFilter.FilterURL(r.URL), err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return proxy
+}
+
+// tripperTransport adapts the server's MultiplexerTripper to an
+// http.RoundTripper. The tripper is looked up on each request since it can be
+// replaced after the server is created.
+type tripperTransport struct {
+	server *Server
+}
+
+func (t *tripperTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Requests made via http.Client can't have a RequestURI, which is set on
+	// incoming requests
+	outgoing := r.WithContext(r.Context())
+	outgoing.RequestURI = ""
+
+	return t.server.MultiplexerTripper.Request(outgoing)
+}
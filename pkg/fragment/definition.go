@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
@@ -18,7 +19,41 @@ type Definition struct {
 	dynamicParts     []string
 	Metadata         map[string]string
 	IgnoreValidation bool
-	children         map[string]*Definition
+	// Optional fragments are replaced with FallbackHTML when they error, time
+	// out, or return a non-2xx status instead of failing the entire page.
+	Optional     bool
+	FallbackHTML []byte
+	// Timeout sets a deadline for the fragment request that is tighter than
+	// the page-wide ProxyTimeout. Zero means only ProxyTimeout applies.
+	Timeout time.Duration
+	// Deferred fragments are sent after the rest of the document when
+	// streaming, and swapped into their placeholder on the client.
+	Deferred bool
+	// IgnoreHeaders excludes the fragment's response headers from the headers
+	// sent to the client.
+	IgnoreHeaders bool
+	// The name of the server backend the fragment is fetched from. Empty
+	// uses the server's target.
+	Backend string
+	// Redirects allows a 3xx response from the fragment to redirect the
+	// client. The root fragment can always redirect.
+	Redirects bool
+	// Priority orders the fragment's request when it is queued by the server's
+	// FragmentLimiter. Zero uses 1 for fragments with children, such as
+	// layouts, and 0 for other fragments.
+	Priority int
+	// RetryPolicy retries the fragment request when it fails with a transient
+	// error. Nil uses the server's FragmentRetryPolicy.
+	RetryPolicy *multiplexer.RetryPolicy
+	// CacheTTL and CacheVary configure how long the fragment is cached for
+	// and which request headers it varies on, when the server has a cache.
+	CacheTTL  time.Duration
+	CacheVary []string
+	// How long an expired cached fragment can be served while it is refreshed
+	// in the background, or when the target fails.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	children             map[string]*Definition
 }
 
 func Define(path string, options ...DefinitionOption) *Definition {
@@ -74,6 +109,110 @@ func WithoutValidation() DefinitionOption {
 	}
 }
 
+// WithoutHeaders excludes the fragment's response headers, including
+// `Set-Cookie`, from the headers sent to the client.
+func WithoutHeaders() DefinitionOption {
+	return func(definition *Definition) {
+		definition.IgnoreHeaders = true
+	}
+}
+
+// WithBackend fetches the fragment from the server backend with the given name
+// instead of the server's target.
+func WithBackend(name string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Backend = name
+	}
+}
+
+// WithRedirects sends 3xx responses from the fragment to the client as a
+// redirect instead of failing the request, e.g. when the fragment requires the
+// user to log in.
+func WithRedirects() DefinitionOption {
+	return func(definition *Definition) {
+		definition.Redirects = true
+	}
+}
+
+// WithPriority sets the priority of the fragment's request when it is queued
+// behind other fragment requests. Higher priorities are sent first.
+func WithPriority(priority int) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Priority = priority
+	}
+}
+
+// WithRetries retries the fragment request according to the given policy when
+// it fails with a connection error or a retryable status.
+func WithRetries(policy multiplexer.RetryPolicy) DefinitionOption {
+	return func(definition *Definition) {
+		definition.RetryPolicy = &policy
+	}
+}
+
+// Optional marks the fragment as optional. When an optional fragment fails it is
+// rendered as an empty string and the rest of the page is still rendered.
+func Optional() DefinitionOption {
+	return func(definition *Definition) {
+		definition.Optional = true
+	}
+}
+
+// WithFallback marks the fragment as optional and renders the given HTML in
+// place of the fragment when it fails.
+func WithFallback(html string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Optional = true
+		definition.FallbackHTML = []byte(html)
+	}
+}
+
+// WithTimeout sets the maximum duration of the fragment request. The page-wide
+// ProxyTimeout still applies when it is shorter.
+func WithTimeout(timeout time.Duration) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Timeout = timeout
+	}
+}
+
+// Deferred marks the fragment as deferred. When the server is streaming and the
+// client supports JavaScript, the rest of the page is sent without waiting for
+// the fragment, and the fragment is sent at the end of the document along with
+// a script that swaps it into its placeholder.
+func Deferred() DefinitionOption {
+	return func(definition *Definition) {
+		definition.Deferred = true
+	}
+}
+
+// WithCache caches the fragment for the given TTL when the server has a
+// fragment cache. The cached fragment is keyed on its URL and the values of the
+// given request headers, so fragments that depend on the user should include
+// headers like `Cookie`.
+func WithCache(ttl time.Duration, varyHeaders ...string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.CacheTTL = ttl
+		definition.CacheVary = varyHeaders
+	}
+}
+
+// WithStaleWhileRevalidate serves a cached fragment for up to the given duration
+// after it expires, while it is refreshed in the background.
+func WithStaleWhileRevalidate(window time.Duration) DefinitionOption {
+	return func(definition *Definition) {
+		definition.StaleWhileRevalidate = window
+	}
+}
+
+// WithStaleIfError serves a cached fragment for up to the given duration after
+// it expires when the target returns a 5xx status, times out, or can't be
+// reached.
+func WithStaleIfError(window time.Duration) DefinitionOption {
+	return func(definition *Definition) {
+		definition.StaleIfError = window
+	}
+}
+
 func WithMetadata(metadata map[string]string) DefinitionOption {
 	return func(definition *Definition) {
 		definition.Metadata = metadata
@@ -136,10 +275,67 @@ type Request struct {
 	RequestURL  *url.URL
 	Definition  *Definition
 	templateURL *url.URL
+	// The key of the fragment within the route, e.g. `root.layout.header`
+	FragmentKey string
+	// The backend the fragment is fetched from, or nil for the server's target
+	TargetBackend *multiplexer.Backend
 }
 
 var _ multiplexer.Requestable = &Request{}
+var _ multiplexer.FallbackRequestable = &Request{}
+var _ multiplexer.TimeoutRequestable = &Request{}
+var _ multiplexer.CacheableRequestable = &Request{}
+var _ multiplexer.StaleRequestable = &Request{}
+var _ multiplexer.KeyedRequestable = &Request{}
+var _ multiplexer.BackendRequestable = &Request{}
+var _ multiplexer.RetryableRequestable = &Request{}
+var _ multiplexer.PrioritizedRequestable = &Request{}
 
 func (fr *Request) URL() string                 { return fr.RequestURL.String() }
 func (fr *Request) TemplateURL() string         { return fr.templateURL.String() }
 func (fr *Request) Metadata() map[string]string { return fr.Definition.Metadata }
+func (fr *Request) Key() string                 { return fr.FragmentKey }
+
+func (fr *Request) Backend() *multiplexer.Backend {
+	return fr.TargetBackend
+}
+
+func (fr *Request) Priority() int {
+	if fr.Definition.Priority != 0 {
+		return fr.Definition.Priority
+	}
+
+	if len(fr.Definition.Children()) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func (fr *Request) RetryPolicy() *multiplexer.RetryPolicy {
+	return fr.Definition.RetryPolicy
+}
+
+func (fr *Request) Fallback() ([]byte, bool) {
+	return fr.Definition.FallbackHTML, fr.Definition.Optional
+}
+
+func (fr *Request) Timeout() time.Duration {
+	return fr.Definition.Timeout
+}
+
+func (fr *Request) CacheTTL() time.Duration {
+	return fr.Definition.CacheTTL
+}
+
+func (fr *Request) CacheVary() []string {
+	return fr.Definition.CacheVary
+}
+
+func (fr *Request) StaleWhileRevalidate() time.Duration {
+	return fr.Definition.StaleWhileRevalidate
+}
+
+func (fr *Request) StaleIfError() time.Duration {
+	return fr.Definition.StaleIfError
+}
@@ -44,3 +44,36 @@ func TestFragment_IntoRequestable_HandlesURLEncodings(t *testing.T) {
 	require.Equal(t, "http://fake.net/hello/mulder%2fscully", requestable.URL())
 	require.Equal(t, "http://fake.net/hello/:name", requestable.TemplateURL())
 }
+
+func TestFragment_Fallback(t *testing.T) {
+	requestable, err := Define("/hello").Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	_, optional := requestable.Fallback()
+	require.False(t, optional)
+
+	requestable, err = Define("/hello", Optional()).Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	body, optional := requestable.Fallback()
+	require.True(t, optional)
+	require.Empty(t, body)
+
+	requestable, err = Define("/hello", WithFallback("<p>unavailable</p>")).Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	body, optional = requestable.Fallback()
+	require.True(t, optional)
+	require.Equal(t, "<p>unavailable</p>", string(body))
+}
+
+func TestFragment_Priority(t *testing.T) {
+	requestable, err := Define("/hello").Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, 0, requestable.Priority())
+
+	requestable, err = Define("/layout", WithChild("hello", Define("/hello"))).Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, 1, requestable.Priority())
+
+	requestable, err = Define("/hello", WithPriority(5)).Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, 5, requestable.Priority())
+}
@@ -0,0 +1,333 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// Strategy determines which upstream a Balancer sends each request to.
+type Strategy int
+
+const (
+	// RoundRobin sends requests to each upstream in turn.
+	RoundRobin Strategy = iota
+	// LeastOutstanding sends requests to the upstream with the fewest
+	// in-flight requests.
+	LeastOutstanding
+	// ConsistentHash sends requests for the same path and query to the same
+	// upstream, which improves the hit rate of caches in the upstreams.
+	ConsistentHash
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultMaxFailures         = 5
+	defaultEjectionDuration    = 30 * time.Second
+	// the number of points each upstream has on the consistent hash ring
+	virtualNodes = 100
+)
+
+// Config configures how a Balancer picks upstreams and checks their health.
+type Config struct {
+	Strategy Strategy
+	// The path requested on each upstream to check its health, e.g. `/_ping`.
+	// Upstreams start healthy, are marked unhealthy when a check doesn't
+	// return a 2xx status, and healthy again once a check does. When empty,
+	// active health checks are disabled.
+	HealthCheckPath string
+	// How often health checks are made. Defaults to 10 seconds.
+	HealthCheckInterval time.Duration
+	// The maximum duration of each health check. Defaults to 2 seconds.
+	HealthCheckTimeout time.Duration
+	// The number of consecutive failed requests, either errors or 5xx
+	// statuses, before an upstream is ejected. Defaults to 5.
+	MaxFailures int
+	// How long an upstream is ejected for after MaxFailures. Defaults to 30
+	// seconds.
+	EjectionDuration time.Duration
+}
+
+// Balancer is a multiplexer.Tripper that spreads requests over a list of
+// upstreams by replacing the scheme and host of each request.
+//
+// When every upstream is unhealthy or ejected, requests are spread over all of
+// the upstreams instead of failing.
+type Balancer struct {
+	upstreams []*upstream
+	tripper   multiplexer.Tripper
+	config    Config
+	ring      []ringNode
+	mu        sync.Mutex
+	next      int
+	now       func() time.Time
+	stop      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+type upstream struct {
+	url          *url.URL
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+	outstanding  int
+}
+
+type ringNode struct {
+	hash     uint32
+	upstream *upstream
+}
+
+var _ multiplexer.Tripper = &Balancer{}
+
+// New returns a Balancer that makes requests to the given upstream URLs using
+// tripper. Active health checks are started when HealthCheckPath is set and
+// run until Close is called.
+func New(upstreamURLs []string, tripper multiplexer.Tripper, config Config) (*Balancer, error) {
+	if len(upstreamURLs) == 0 {
+		return nil, fmt.Errorf("loadbalancer: at least one upstream is required")
+	}
+
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if config.HealthCheckTimeout == 0 {
+		config.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if config.MaxFailures == 0 {
+		config.MaxFailures = defaultMaxFailures
+	}
+	if config.EjectionDuration == 0 {
+		config.EjectionDuration = defaultEjectionDuration
+	}
+
+	b := &Balancer{
+		tripper: tripper,
+		config:  config,
+		now:     time.Now,
+		stop:    make(chan struct{}),
+	}
+
+	for _, upstreamURL := range upstreamURLs {
+		parsed, err := url.Parse(upstreamURL)
+		if err != nil {
+			return nil, fmt.Errorf("loadbalancer: invalid upstream %s: %w", upstreamURL, err)
+		}
+
+		b.upstreams = append(b.upstreams, &upstream{url: parsed, healthy: true})
+	}
+
+	b.buildRing()
+
+	if config.HealthCheckPath != "" {
+		b.wg.Add(1)
+		go b.runHealthChecks()
+	}
+
+	return b, nil
+}
+
+// Close stops active health checks.
+func (b *Balancer) Close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	b.wg.Wait()
+}
+
+// Available returns the upstreams that are healthy and not ejected.
+func (b *Balancer) Available() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	available := make([]string, 0, len(b.upstreams))
+	for _, u := range b.available() {
+		available = append(available, u.url.String())
+	}
+
+	return available
+}
+
+func (b *Balancer) Request(r *http.Request) (*http.Response, error) {
+	u := b.pick(r)
+
+	outgoing := r.Clone(r.Context())
+	outgoing.URL.Scheme = u.url.Scheme
+	outgoing.URL.Host = u.url.Host
+	outgoing.Host = u.url.Host
+
+	res, err := b.tripper.Request(outgoing)
+
+	// Requests canceled by the caller, e.g. because another fragment failed,
+	// are not the upstream's fault.
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		b.done(u, true)
+	} else {
+		b.done(u, err == nil && res.StatusCode < 500)
+	}
+
+	return res, err
+}
+
+// pick returns the upstream for the given request and marks it as having an
+// outstanding request.
+func (b *Balancer) pick(r *http.Request) *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	candidates := b.available()
+	if len(candidates) == 0 {
+		candidates = b.upstreams
+	}
+
+	var picked *upstream
+
+	switch b.config.Strategy {
+	case LeastOutstanding:
+		offset := b.next % len(candidates)
+		b.next++
+
+		for i := range candidates {
+			candidate := candidates[(offset+i)%len(candidates)]
+			if picked == nil || candidate.outstanding < picked.outstanding {
+				picked = candidate
+			}
+		}
+	case ConsistentHash:
+		picked = b.hashed(r.URL.RequestURI(), candidates)
+	default:
+		picked = candidates[b.next%len(candidates)]
+		b.next++
+	}
+
+	picked.outstanding++
+	return picked
+}
+
+// done records the outcome of a request, ejecting the upstream after
+// MaxFailures consecutive failures.
+func (b *Balancer) done(u *upstream, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u.outstanding--
+
+	if success {
+		u.failures = 0
+		return
+	}
+
+	u.failures++
+	if u.failures >= b.config.MaxFailures {
+		u.failures = 0
+		u.ejectedUntil = b.now().Add(b.config.EjectionDuration)
+	}
+}
+
+func (b *Balancer) available() []*upstream {
+	now := b.now()
+	available := make([]*upstream, 0, len(b.upstreams))
+
+	for _, u := range b.upstreams {
+		if u.healthy && !now.Before(u.ejectedUntil) {
+			available = append(available, u)
+		}
+	}
+
+	return available
+}
+
+func (b *Balancer) buildRing() {
+	for _, u := range b.upstreams {
+		for i := 0; i < virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(u.url.String() + "#" + strconv.Itoa(i)))
+			b.ring = append(b.ring, ringNode{hash: hash, upstream: u})
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// hashed returns the first candidate found on the ring after the hash of key,
+// so that keys only move to another upstream when theirs is unavailable.
+func (b *Balancer) hashed(key string, candidates []*upstream) *upstream {
+	isCandidate := make(map[*upstream]bool, len(candidates))
+	for _, candidate := range candidates {
+		isCandidate[candidate] = true
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+
+	for i := 0; i < len(b.ring); i++ {
+		node := b.ring[(start+i)%len(b.ring)]
+		if isCandidate[node.upstream] {
+			return node.upstream
+		}
+	}
+
+	return candidates[0]
+}
+
+func (b *Balancer) runHealthChecks() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		b.checkHealth()
+
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Balancer) checkHealth() {
+	var wg sync.WaitGroup
+
+	for _, u := range b.upstreams {
+		wg.Add(1)
+
+		go func(u *upstream) {
+			defer wg.Done()
+			healthy := b.isHealthy(u)
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			u.healthy = healthy
+		}(u)
+	}
+
+	wg.Wait()
+}
+
+func (b *Balancer) isHealthy(u *upstream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.HealthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url.JoinPath(b.config.HealthCheckPath).String(), nil)
+	if err != nil {
+		return false
+	}
+
+	res, err := b.tripper.Request(req)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode >= 200 && res.StatusCode <= 299
+}
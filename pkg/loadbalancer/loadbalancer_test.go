@@ -0,0 +1,222 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+type upstreamServer struct {
+	*httptest.Server
+	requests int32
+	status   int32
+	healthy  int32
+}
+
+func newUpstreamServer(t *testing.T, name string) *upstreamServer {
+	upstream := &upstreamServer{status: http.StatusOK, healthy: 1}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			if atomic.LoadInt32(&upstream.healthy) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		atomic.AddInt32(&upstream.requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&upstream.status)))
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+func request(t *testing.T, b *Balancer, path string) (int, string) {
+	r, err := http.NewRequest(http.MethodGet, "http://localhost:1"+path, nil)
+	require.NoError(t, err)
+
+	res, err := b.Request(r)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return res.StatusCode, string(body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	one := newUpstreamServer(t, "one")
+	two := newUpstreamServer(t, "two")
+
+	b, err := New([]string{one.URL, two.URL}, multiplexer.NewStandardTripper(&http.Client{}), Config{})
+	require.NoError(t, err)
+	defer b.Close()
+
+	bodies := make([]string, 4)
+	for i := range bodies {
+		_, bodies[i] = request(t, b, "/fragment")
+	}
+
+	require.Equal(t, []string{"one", "two", "one", "two"}, bodies)
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := newUpstreamServer(t, "fast")
+
+	b, err := New([]string{slow.URL, fast.URL}, multiplexer.NewStandardTripper(&http.Client{}), Config{Strategy: LeastOutstanding})
+	require.NoError(t, err)
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, body := request(t, b, "/fragment")
+		require.Equal(t, "slow", body)
+	}()
+
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.upstreams[0].outstanding == 1
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		_, body := request(t, b, "/fragment")
+		require.Equal(t, "fast", body)
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func TestConsistentHash(t *testing.T) {
+	upstreams := []*upstreamServer{newUpstreamServer(t, "one"), newUpstreamServer(t, "two"), newUpstreamServer(t, "three")}
+	urls := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		urls[i] = upstream.URL
+	}
+
+	b, err := New(urls, multiplexer.NewStandardTripper(&http.Client{}), Config{Strategy: ConsistentHash, MaxFailures: 1})
+	require.NoError(t, err)
+	defer b.Close()
+
+	picked := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		path := "/fragment?id=" + strconv.Itoa(i)
+		_, picked[path] = request(t, b, path)
+
+		for j := 0; j < 3; j++ {
+			_, body := request(t, b, path)
+			require.Equal(t, picked[path], body)
+		}
+	}
+
+	// Ejecting an upstream only moves the paths it served
+	atomic.StoreInt32(&upstreams[0].status, http.StatusInternalServerError)
+	for path := range picked {
+		request(t, b, path)
+	}
+	require.NotContains(t, b.Available(), upstreams[0].URL)
+
+	for path, body := range picked {
+		_, moved := request(t, b, path)
+
+		if body == "one" {
+			require.NotEqual(t, "one", moved)
+		} else {
+			require.Equal(t, body, moved)
+		}
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	failing := newUpstreamServer(t, "failing")
+	atomic.StoreInt32(&failing.status, http.StatusBadGateway)
+	ok := newUpstreamServer(t, "ok")
+
+	b, err := New([]string{failing.URL, ok.URL}, multiplexer.NewStandardTripper(&http.Client{}), Config{MaxFailures: 2, EjectionDuration: time.Minute})
+	require.NoError(t, err)
+	defer b.Close()
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		request(t, b, "/fragment")
+	}
+	require.Equal(t, []string{ok.URL}, b.Available())
+
+	for i := 0; i < 4; i++ {
+		status, body := request(t, b, "/fragment")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "ok", body)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&failing.requests))
+
+	now = now.Add(time.Minute)
+	require.Equal(t, []string{failing.URL, ok.URL}, b.Available())
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	one := newUpstreamServer(t, "one")
+	two := newUpstreamServer(t, "two")
+	atomic.StoreInt32(&one.healthy, 0)
+
+	b, err := New(
+		[]string{one.URL, two.URL},
+		multiplexer.NewStandardTripper(&http.Client{}),
+		Config{HealthCheckPath: "/_ping", HealthCheckInterval: 10 * time.Millisecond},
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.Eventually(t, func() bool { return len(b.Available()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{two.URL}, b.Available())
+
+	for i := 0; i < 3; i++ {
+		_, body := request(t, b, "/fragment")
+		require.Equal(t, "two", body)
+	}
+
+	atomic.StoreInt32(&one.healthy, 1)
+	require.Eventually(t, func() bool { return len(b.Available()) == 2 }, time.Second, time.Millisecond)
+}
+
+func TestAllUpstreamsUnavailable(t *testing.T) {
+	one := newUpstreamServer(t, "one")
+	atomic.StoreInt32(&one.status, http.StatusInternalServerError)
+
+	b, err := New([]string{one.URL}, multiplexer.NewStandardTripper(&http.Client{}), Config{MaxFailures: 1})
+	require.NoError(t, err)
+	defer b.Close()
+
+	request(t, b, "/fragment")
+	require.Empty(t, b.Available())
+
+	atomic.StoreInt32(&one.status, http.StatusOK)
+	status, body := request(t, b, "/fragment")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "one", body)
+}
+
+func TestNewRequiresUpstreams(t *testing.T) {
+	_, err := New(nil, multiplexer.NewStandardTripper(&http.Client{}), Config{})
+	require.Error(t, err)
+}
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
+)
+
+// Metrics collects request, fragment and pass through metrics and exposes them
+// in the Prometheus text exposition format.
+type Metrics struct {
+	requests         *counterVec
+	requestDuration  *histogramVec
+	inFlight         *gauge
+	passThrough      *counterVec
+	fragmentDuration *histogramVec
+	fragmentTimeouts *counterVec
+	fragmentErrors   *counterVec
+	resultErrors     *counterVec
+	all              []metric
+}
+
+// New returns Metrics using DefaultBuckets for latency histograms.
+func New() *Metrics {
+	return NewWithBuckets(DefaultBuckets)
+}
+
+// NewWithBuckets returns Metrics using the given histogram bucket upper
+// bounds, in seconds.
+func NewWithBuckets(buckets []float64) *Metrics {
+	m := &Metrics{
+		requests:         newCounterVec("viewproxy_requests_total", "Requests handled by a route.", "route", "code"),
+		requestDuration:  newHistogramVec("viewproxy_request_duration_seconds", "Time spent handling requests for a route.", buckets, "route"),
+		inFlight:         newGauge("viewproxy_requests_in_flight", "Requests currently being handled."),
+		passThrough:      newCounterVec("viewproxy_passthrough_requests_total", "Requests that did not match a route.", "code"),
+		fragmentDuration: newHistogramVec("viewproxy_fragment_duration_seconds", "Time spent fetching fragments.", buckets, "template_url", "code"),
+		fragmentTimeouts: newCounterVec("viewproxy_fragment_timeouts_total", "Fragment requests that timed out.", "template_url"),
+		fragmentErrors:   newCounterVec("viewproxy_fragment_errors_total", "Fragment requests that failed without a response.", "template_url"),
+		resultErrors:     newCounterVec("viewproxy_fragment_result_errors_total", "Fragment responses with a non-2xx status, which are returned as a ResultError unless accepted by the route.", "template_url", "code"),
+	}
+
+	m.all = []metric{
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		m.passThrough,
+		m.fragmentDuration,
+		m.fragmentTimeouts,
+		m.fragmentErrors,
+		m.resultErrors,
+	}
+
+	return m
+}
+
+// Handler returns an http.Handler that writes the metrics in the Prometheus
+// text exposition format, to be mounted at e.g. `/metrics`.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		for _, metric := range m.all {
+			metric.write(w)
+		}
+	})
+}
+
+// Middleware records request counts, latency and in-flight requests. It is
+// intended to be used in `Server.AroundRequest`.
+func (m *Metrics) Middleware(server *viewproxy.Server) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := viewproxy.RouteFromContext(r.Context())
+
+			m.inFlight.add(1)
+			defer m.inFlight.add(-1)
+
+			wrapper := &responseWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(wrapper, r)
+
+			code := strconv.Itoa(wrapper.statusCode)
+
+			if route != nil {
+				m.requests.inc(route.Path, code)
+				m.requestDuration.observe(time.Since(start).Seconds(), route.Path)
+			} else if server.PassThroughEnabled() {
+				m.passThrough.inc(code)
+			}
+		})
+	}
+}
+
+type metricsTripper struct {
+	metrics      *Metrics
+	secretFilter secretfilter.Filter
+	tripper      multiplexer.Tripper
+}
+
+// NewTripper wraps the given tripper, recording the latency and status of
+// fragment requests by template URL. Template URLs are filtered by the given
+// secret filter, since the metrics endpoint is usually unauthenticated.
+func (m *Metrics) NewTripper(sf secretfilter.Filter, tripper multiplexer.Tripper) multiplexer.Tripper {
+	return &metricsTripper{metrics: m, secretFilter: sf, tripper: tripper}
+}
+
+func (t *metricsTripper) Request(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.tripper.Request(r)
+	duration := time.Since(start)
+	requestable := multiplexer.RequestableFromContext(r.Context())
+
+	// If requestable is nil, we are proxying, which is recorded by Middleware
+	if requestable == nil {
+		return res, err
+	}
+
+	templateURL := t.secretFilter.FilterURLString(requestable.TemplateURL())
+
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			t.metrics.fragmentTimeouts.inc(templateURL)
+		} else {
+			t.metrics.fragmentErrors.inc(templateURL)
+		}
+
+		return res, err
+	}
+
+	code := strconv.Itoa(res.StatusCode)
+	t.metrics.fragmentDuration.observe(duration.Seconds(), templateURL, code)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		t.metrics.resultErrors.inc(templateURL, code)
+	}
+
+	return res, err
+}
+
+type responseWrapper struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (rw *responseWrapper) WriteHeader(statusCode int) {
+	if !rw.wroteHeader {
+		rw.statusCode = statusCode
+		rw.wroteHeader = true
+	}
+
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush allows streamed responses to be flushed through the wrapper.
+func (rw *responseWrapper) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack allows pass through requests to upgrade the connection.
+func (rw *responseWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+
+	return nil, nil, http.ErrNotSupported
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpositionFormat(t *testing.T) {
+	counter := newCounterVec("test_total", "A test counter.", "path")
+	counter.inc(`/with "quotes"`)
+	counter.add(2, "/")
+
+	histogram := newHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "path")
+	histogram.observe(0.05, "/")
+	histogram.observe(0.5, "/")
+	histogram.observe(5, "/")
+
+	var b bytes.Buffer
+	counter.write(&b)
+	histogram.write(&b)
+
+	require.Equal(t, `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{path="/"} 2
+test_total{path="/with \"quotes\""} 1
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{path="/",le="0.1"} 1
+test_seconds_bucket{path="/",le="1"} 2
+test_seconds_bucket{path="/",le="+Inf"} 3
+test_seconds_sum{path="/"} 5.55
+test_seconds_count{path="/"} 3
+`, b.String())
+}
+
+func TestMetrics(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/body":
+			w.Write([]byte("hello"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	server, err := viewproxy.NewServer(target.URL, viewproxy.WithPassThrough(target.URL))
+	require.NoError(t, err)
+
+	err = server.Get("/hello", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body"))))
+	require.NoError(t, err)
+	err = server.Get("/oops", fragment.Define("/oops"))
+	require.NoError(t, err)
+
+	metrics := New()
+	server.AroundRequest = metrics.Middleware(server)
+	server.MultiplexerTripper = metrics.NewTripper(server.SecretFilter, multiplexer.NewStandardTripper(&http.Client{}))
+
+	for _, path := range []string{"/hello", "/hello", "/oops", "/passthrough"} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, r)
+	}
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, r)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Result().Header.Get("Content-Type"))
+	require.Contains(t, string(body), `viewproxy_requests_total{route="/hello",code="200"} 2`)
+	require.Contains(t, string(body), `viewproxy_requests_total{route="/oops",code="500"} 1`)
+	require.Contains(t, string(body), `viewproxy_request_duration_seconds_count{route="/hello"} 2`)
+	require.Contains(t, string(body), "viewproxy_requests_in_flight 0")
+	require.Contains(t, string(body), `viewproxy_passthrough_requests_total{code="500"} 1`)
+	require.Contains(t, string(body), `viewproxy_fragment_duration_seconds_count{template_url="`+target.URL+`/body",code="200"} 2`)
+	require.Contains(t, string(body), `viewproxy_fragment_result_errors_total{template_url="`+target.URL+`/oops",code="500"} 1`)
+}
+
+func TestMetricsTimeouts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("too slow"))
+	}))
+	defer target.Close()
+
+	server, err := viewproxy.NewServer(target.URL)
+	require.NoError(t, err)
+	server.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	err = server.Get("/hello", fragment.Define("/slow", fragment.WithTimeout(10*time.Millisecond)))
+	require.NoError(t, err)
+
+	metrics := New()
+	server.MultiplexerTripper = metrics.NewTripper(server.SecretFilter, multiplexer.NewStandardTripper(&http.Client{}))
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	var b bytes.Buffer
+	metrics.fragmentTimeouts.write(&b)
+	require.Contains(t, b.String(), `viewproxy_fragment_timeouts_total{template_url="`+target.URL+`/slow"} 1`)
+}
+
+func TestMetricsFilterTemplateURLs(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	require.NoError(t, err)
+	targetURL.User = url.UserPassword("viewproxy", "hunter2")
+
+	server, err := viewproxy.NewServer(targetURL.String())
+	require.NoError(t, err)
+
+	err = server.Get("/hello", fragment.Define("/body"))
+	require.NoError(t, err)
+
+	metrics := New()
+	server.MultiplexerTripper = metrics.NewTripper(server.SecretFilter, multiplexer.NewStandardTripper(&http.Client{}))
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	var b bytes.Buffer
+	metrics.fragmentDuration.write(&b)
+	require.Contains(t, b.String(), `template_url="http://FILTERED:FILTERED@`+targetURL.Host+`/body"`)
+	require.NotContains(t, b.String(), "hunter2")
+}
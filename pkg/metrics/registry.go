@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histograms.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a set of counters partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*counter
+}
+
+type counter struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counter)}
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	value, ok := c.values[key]
+	if !ok {
+		value = &counter{labelValues: labelValues}
+		c.values[key] = value
+	}
+
+	value.value += delta
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, value.labelValues), formatValue(value.value))
+	}
+}
+
+// gauge is a single value that can go up and down.
+type gauge struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+func newGauge(name string, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.value += delta
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value))
+}
+
+// histogramVec is a set of histograms partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := h.values[key]
+	if !ok {
+		series = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+
+	series.count++
+	series.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	bucketLabels := append(append(make([]string, 0, len(h.labels)+1), h.labels...), "le")
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		histogram := h.values[key]
+
+		for i, bound := range h.buckets {
+			labelValues := append(append(make([]string, 0, len(bucketLabels)), histogram.labelValues...), formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), histogram.counts[i])
+		}
+
+		labelValues := append(append(make([]string, 0, len(bucketLabels)), histogram.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), histogram.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, histogram.labelValues), formatValue(histogram.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, histogram.labelValues), histogram.count)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var labels strings.Builder
+	labels.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			labels.WriteByte(',')
+		}
+
+		fmt.Fprintf(&labels, `%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+
+	labels.WriteByte('}')
+	return labels.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
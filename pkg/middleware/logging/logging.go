@@ -32,6 +32,13 @@ func (rw *ResponseWrapper) WriteHeader(statusCode int) {
 	rw.responseWriter.WriteHeader(statusCode)
 }
 
+// Flush allows streamed responses to be flushed through the wrapper.
+func (rw *ResponseWrapper) Flush() {
+	if flusher, ok := rw.responseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func Middleware(server *viewproxy.Server, l logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1,10 +1,18 @@
 package logging
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -96,6 +104,140 @@ func TestLogTripperFragments(t *testing.T) {
 	require.Regexp(t, regexp.MustCompile(`Fragment 200 in \d+ms for http:\/\/.*`), log.logs[1])
 }
 
+func TestLogTripperPassThrough(t *testing.T) {
+	targetServer := startTargetServer()
+	viewProxyServer, err := viewproxy.NewServer(targetServer.URL, viewproxy.WithPassThrough(targetServer.URL))
+	require.NoError(t, err)
+
+	log := &SliceLogger{logs: make([]string, 0)}
+	viewProxyServer.MultiplexerTripper = NewLogTripper(log, secretfilter.New(), multiplexer.NewStandardTripper(&http.Client{}))
+
+	r := httptest.NewRequest("GET", "/fake?token=secret", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+	resp := w.Result()
+	require.Equal(t, 404, resp.StatusCode)
+
+	require.Len(t, log.logs, 1)
+	require.Regexp(t, regexp.MustCompile(`Proxy request 404 in \d+ms for http://.*/fake\?token=FILTERED`), log.logs[0])
+}
+
+func TestStructuredLogging(t *testing.T) {
+	targetServer := startTargetServer()
+	viewProxyServer, err := viewproxy.NewServer(targetServer.URL, viewproxy.WithPassThrough(targetServer.URL))
+	require.NoError(t, err)
+
+	viewProxyServer.Get(
+		"/hello/:name",
+		fragment.Define("/layouts/test_layout/:name", fragment.WithChild("body", fragment.Define("/body/:name"))),
+	)
+
+	var b bytes.Buffer
+	var mu sync.Mutex
+	logger := slog.New(slog.NewJSONHandler(&lockedWriter{w: &b, mu: &mu}, nil))
+
+	viewProxyServer.AroundRequest = StructuredMiddleware(viewProxyServer, logger)
+	viewProxyServer.MultiplexerTripper = NewStructuredLogTripper(logger, secretfilter.New(), multiplexer.NewStandardTripper(&http.Client{}))
+
+	r := httptest.NewRequest("GET", "/hello/world?token=secret", nil)
+	r.Header.Set(HeaderRequestID, "abc123")
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	r = httptest.NewRequest("GET", "/missing", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+	require.Equal(t, 404, w.Result().StatusCode)
+
+	records := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+
+	require.Len(t, records, 5)
+
+	fragments := records[:2]
+	sort.Slice(fragments, func(i, j int) bool { return fragments[i]["fragment"].(string) < fragments[j]["fragment"].(string) })
+
+	require.Equal(t, "fragment", fragments[0]["msg"])
+	require.Equal(t, "root", fragments[0]["fragment"])
+	require.Equal(t, "abc123", fragments[0]["request_id"])
+	require.Equal(t, targetServer.URL+"/layouts/test_layout/world?token=FILTERED", fragments[0]["url"])
+	require.Equal(t, float64(200), fragments[0]["status"])
+	require.Equal(t, float64(len("<html><view-proxy-content></view-proxy-content></html>")), fragments[0]["bytes"])
+	require.Contains(t, fragments[0], "duration_ms")
+	require.Equal(t, "root.body", fragments[1]["fragment"])
+
+	require.Equal(t, "request", records[2]["msg"])
+	require.Equal(t, "abc123", records[2]["request_id"])
+	require.Equal(t, "/hello/:name", records[2]["route"])
+	require.Equal(t, "/hello/world?token=FILTERED", records[2]["url"])
+	require.Equal(t, float64(200), records[2]["status"])
+	require.Equal(t, false, records[2]["passthrough"])
+	require.Contains(t, records[2], "duration_ms")
+
+	require.Equal(t, "proxy", records[3]["msg"])
+	require.Equal(t, targetServer.URL+"/missing", records[3]["url"])
+	require.Equal(t, float64(404), records[3]["status"])
+
+	require.Equal(t, "request", records[4]["msg"])
+	require.NotEmpty(t, records[4]["request_id"])
+	require.Equal(t, records[3]["request_id"], records[4]["request_id"])
+	require.NotContains(t, records[4], "route")
+	require.Equal(t, float64(404), records[4]["status"])
+	require.Equal(t, true, records[4]["passthrough"])
+}
+
+type failingTripper struct{}
+
+func (failingTripper) Request(r *http.Request) (*http.Response, error) {
+	return nil, &url.Error{Op: "Get", URL: r.URL.String(), Err: errors.New("connection refused")}
+}
+
+func TestStructuredLoggingFiltersErrors(t *testing.T) {
+	viewProxyServer, err := viewproxy.NewServer("http://localhost:9994", viewproxy.WithPassThrough("http://localhost:9994"))
+	require.NoError(t, err)
+	viewProxyServer.Logger = log.New(io.Discard, "", log.Ldate|log.Ltime)
+
+	viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name"))
+
+	var b bytes.Buffer
+	var mu sync.Mutex
+	logger := slog.New(slog.NewJSONHandler(&lockedWriter{w: &b, mu: &mu}, nil))
+
+	viewProxyServer.MultiplexerTripper = NewStructuredLogTripper(logger, secretfilter.New(), failingTripper{})
+
+	for _, path := range []string{"/hello/world?token=supersecret", "/missing?token=supersecret"} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 2)
+
+	for _, line := range lines {
+		require.Contains(t, line, `"level":"ERROR"`)
+		require.Contains(t, line, "token=FILTERED")
+		require.Contains(t, line, "connection refused")
+		require.NotContains(t, line, "supersecret")
+	}
+}
+
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
 func startTargetServer() *httptest.Server {
 	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		parts := strings.Split(r.URL.Path, "/")
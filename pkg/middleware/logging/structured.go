@@ -0,0 +1,179 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	secretfilter "github.com/blakewilliams/viewproxy/pkg/secretfilter"
+)
+
+// HeaderRequestID is the header used to correlate logs for a request. An ID is
+// generated when the incoming request doesn't have one, and it is forwarded to
+// the target server.
+const HeaderRequestID = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the request ID set by StructuredMiddleware.
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// StructuredMiddleware logs a record for each request containing the route
+// path, status, duration, whether the request was passed through and the
+// request ID.
+func StructuredMiddleware(server *viewproxy.Server, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := viewproxy.RouteFromContext(r.Context())
+
+			requestID := r.Header.Get(HeaderRequestID)
+			if requestID == "" {
+				requestID = newRequestID()
+				r.Header.Set(HeaderRequestID, requestID)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID))
+
+			wrapper := &ResponseWrapper{responseWriter: w, StatusCode: 200} // use default 200 to initialize
+			next.ServeHTTP(wrapper, r)
+
+			attrs := []slog.Attr{
+				slog.String("request_id", requestID),
+				slog.String("method", r.Method),
+				slog.String("url", server.SecretFilter.FilterURL(r.URL).String()),
+				slog.Int("status", wrapper.StatusCode),
+				slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+				slog.Bool("passthrough", route == nil && server.PassThroughEnabled()),
+			}
+
+			if route != nil {
+				attrs = append(attrs, slog.String("route", route.Path))
+			}
+
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+type structuredLogTripper struct {
+	logger       *slog.Logger
+	secretFilter secretfilter.Filter
+	tripper      multiplexer.Tripper
+}
+
+// NewStructuredLogTripper logs a record for each fragment request containing
+// the fragment key, filtered URL, status, duration and response size once the
+// response body is closed.
+func NewStructuredLogTripper(l *slog.Logger, sf secretfilter.Filter, tripper multiplexer.Tripper) multiplexer.Tripper {
+	return &structuredLogTripper{logger: l, secretFilter: sf, tripper: tripper}
+}
+
+func (t *structuredLogTripper) Request(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.tripper.Request(r)
+	requestable := multiplexer.RequestableFromContext(r.Context())
+
+	attrs := []slog.Attr{slog.String("request_id", RequestIDFromContext(r.Context()))}
+
+	// If requestable is nil, we are proxying
+	requestURL := r.URL.String()
+	if requestable != nil {
+		requestURL = requestable.URL()
+		attrs = append(attrs, slog.String("url", t.secretFilter.FilterURLString(requestable.URL())))
+
+		if keyed, ok := requestable.(multiplexer.KeyedRequestable); ok {
+			attrs = append(attrs, slog.String("fragment", keyed.Key()))
+		}
+	} else {
+		attrs = append(attrs, slog.String("url", t.secretFilter.FilterURL(r.URL).String()))
+	}
+
+	message := "fragment"
+	if requestable == nil {
+		message = "proxy"
+	}
+
+	if err != nil {
+		attrs = append(attrs,
+			slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+			slog.String("error", t.filterError(requestURL, err).Error()),
+		)
+		t.logger.LogAttrs(r.Context(), slog.LevelError, message, attrs...)
+
+		return nil, err
+	}
+
+	attrs = append(attrs, slog.Int("status", res.StatusCode))
+
+	res.Body = &loggedBody{
+		ReadCloser: res.Body,
+		onClose: func(bytes int64) {
+			attrs = append(attrs,
+				slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+				slog.Int64("bytes", bytes),
+			)
+			t.logger.LogAttrs(r.Context(), slog.LevelInfo, message, attrs...)
+		},
+	}
+
+	return res, err
+}
+
+// filterError filters the URL of url.Errors, which otherwise contain the
+// unfiltered request URL.
+func (t *structuredLogTripper) filterError(errURL string, err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return t.secretFilter.FilterURLError(errURL, urlErr)
+	}
+
+	return err
+}
+
+// loggedBody counts the bytes read from a response body and calls onClose once
+// the body is closed, so that the size and full duration can be logged.
+type loggedBody struct {
+	io.ReadCloser
+	bytes   int64
+	once    sync.Once
+	onClose func(bytes int64)
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.onClose(b.bytes) })
+	return err
+}
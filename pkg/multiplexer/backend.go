@@ -0,0 +1,33 @@
+package multiplexer
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/blakewilliams/viewproxy/pkg/signing"
+)
+
+// Backend is a target server that requestables can be fetched from instead of
+// the request's default target, with its own HMAC secret or signer and tripper.
+type Backend struct {
+	URL *url.URL
+	// Sets the secret used to sign requests to the backend. Requests are not
+	// signed when empty and Signer is nil.
+	HmacSecret string
+	// Sets the signer used to sign requests to the backend, which takes
+	// precedence over HmacSecret.
+	Signer *signing.Signer
+	// The tripper used for requests to the backend. Defaults to the request's
+	// Tripper when nil.
+	Tripper Tripper
+}
+
+// NewBackend returns a Backend for the given base URL.
+func NewBackend(target string) (*Backend, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend url %s: %w", target, err)
+	}
+
+	return &Backend{URL: targetURL}, nil
+}
@@ -0,0 +1,215 @@
+package multiplexer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker's circuit for a requestable.
+type CircuitState int
+
+const (
+	// CircuitClosed allows requests and counts consecutive failures.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests immediately with a CircuitOpenError.
+	CircuitOpen
+	// CircuitHalfOpen allows a limited number of trial requests, closing the
+	// circuit when they succeed and opening it again when one fails.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitOpenError is returned for requestables whose circuit is open, without
+// making a request to the target.
+type CircuitOpenError struct {
+	TemplateURL string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s", e.TemplateURL)
+}
+
+var _ error = &CircuitOpenError{}
+
+// CircuitBreaker stops requests to requestables that are failing, keyed by
+// their template URL, so that pages fail or render fallbacks immediately
+// instead of waiting on a target that is known to be unhealthy.
+//
+// Errors, timeouts, and 5xx responses count as failures. A circuit opens after
+// FailureThreshold consecutive failures, and after OpenDuration allows
+// HalfOpenRequests trial requests through to decide whether to close again.
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+	// The number of successful trial requests needed to close a half-open
+	// circuit, which is also the number of trial requests allowed at once.
+	// Defaults to 1.
+	HalfOpenRequests int
+	mu               sync.Mutex
+	circuits         map[string]*circuit
+	now              func() time.Time
+}
+
+type circuit struct {
+	state     CircuitState
+	failures  int
+	successes int
+	trials    int
+	openedAt  time.Time
+}
+
+// CircuitTransition describes a circuit changing state.
+type CircuitTransition struct {
+	TemplateURL string
+	From        CircuitState
+	To          CircuitState
+}
+
+type circuitOutcome int
+
+const (
+	circuitSuccess circuitOutcome = iota
+	circuitFailure
+	// the request was cancelled by the caller, which says nothing about the
+	// health of the target
+	circuitIgnored
+)
+
+// NewCircuitBreaker returns a CircuitBreaker that opens a circuit after
+// failureThreshold consecutive failures, for openDuration.
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		OpenDuration:     openDuration,
+		HalfOpenRequests: 1,
+		circuits:         make(map[string]*circuit),
+		now:              time.Now,
+	}
+}
+
+// State returns the state of the circuit for the given template URL.
+func (cb *CircuitBreaker) State(templateURL string) CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if c, ok := cb.circuits[templateURL]; ok {
+		return c.state
+	}
+
+	return CircuitClosed
+}
+
+// allow returns whether a request can be made for the given template URL,
+// whether it is a trial request of a half-open circuit, and the transition made
+// when an open circuit becomes half-open.
+func (cb *CircuitBreaker) allow(templateURL string) (bool, bool, *CircuitTransition) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuitFor(templateURL)
+	var transition *CircuitTransition
+
+	if c.state == CircuitOpen {
+		if cb.now().Sub(c.openedAt) < cb.OpenDuration {
+			return false, false, nil
+		}
+
+		transition = cb.transition(templateURL, c, CircuitHalfOpen)
+	}
+
+	if c.state == CircuitHalfOpen {
+		if c.trials >= cb.halfOpenRequests() {
+			return false, false, transition
+		}
+
+		c.trials++
+		return true, true, transition
+	}
+
+	return true, false, transition
+}
+
+// record updates the circuit for the given template URL with the outcome of an
+// allowed request, returning the transition made if any. Outcomes of requests
+// allowed before the circuit last changed state are ignored.
+func (cb *CircuitBreaker) record(templateURL string, trial bool, outcome circuitOutcome) *CircuitTransition {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuitFor(templateURL)
+
+	if trial != (c.state == CircuitHalfOpen) || c.state == CircuitOpen {
+		return nil
+	}
+
+	if trial {
+		c.trials--
+	}
+
+	switch outcome {
+	case circuitSuccess:
+		c.failures = 0
+
+		if c.state == CircuitHalfOpen {
+			c.successes++
+
+			if c.successes >= cb.halfOpenRequests() {
+				return cb.transition(templateURL, c, CircuitClosed)
+			}
+		}
+	case circuitFailure:
+		c.failures++
+
+		if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= cb.FailureThreshold) {
+			return cb.transition(templateURL, c, CircuitOpen)
+		}
+	}
+
+	return nil
+}
+
+func (cb *CircuitBreaker) circuitFor(templateURL string) *circuit {
+	c, ok := cb.circuits[templateURL]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		cb.circuits[templateURL] = c
+	}
+
+	return c
+}
+
+func (cb *CircuitBreaker) transition(templateURL string, c *circuit, to CircuitState) *CircuitTransition {
+	transition := &CircuitTransition{TemplateURL: templateURL, From: c.state, To: to}
+
+	c.state = to
+	c.failures = 0
+	c.successes = 0
+	c.trials = 0
+
+	if to == CircuitOpen {
+		c.openedAt = cb.now()
+	}
+
+	return transition
+}
+
+func (cb *CircuitBreaker) halfOpenRequests() int {
+	if cb.HalfOpenRequests < 1 {
+		return 1
+	}
+
+	return cb.HalfOpenRequests
+}
@@ -0,0 +1,220 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	var requests int32
+	var status int32 = http.StatusInternalServerError
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	var transitions []CircuitTransition
+	do := func() ([]*Result, error) {
+		r := newRequest()
+		r.CircuitBreaker = breaker
+		r.OnCircuitStateChange = func(transition *CircuitTransition) {
+			transitions = append(transitions, *transition)
+		}
+		r.WithRequestable(newFakeRequestable(server.URL + "/sidebar"))
+
+		return r.Do(context.Background())
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := do()
+		var resultErr *ResultError
+		require.ErrorAs(t, err, &resultErr)
+	}
+	require.Equal(t, CircuitOpen, breaker.State(server.URL+"/sidebar"))
+
+	_, err := do()
+	var openErr *CircuitOpenError
+	require.ErrorAs(t, err, &openErr)
+	require.Equal(t, server.URL+"/sidebar", openErr.TemplateURL)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// A failed trial request opens the circuit again
+	now = now.Add(time.Minute)
+	_, err = do()
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, CircuitOpen, breaker.State(server.URL+"/sidebar"))
+
+	// A successful trial request closes the circuit
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&status, http.StatusOK)
+	_, err = do()
+	require.NoError(t, err)
+	require.Equal(t, CircuitClosed, breaker.State(server.URL+"/sidebar"))
+	require.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+	templateURL := server.URL + "/sidebar"
+	require.Equal(t, []CircuitTransition{
+		{TemplateURL: templateURL, From: CircuitClosed, To: CircuitOpen},
+		{TemplateURL: templateURL, From: CircuitOpen, To: CircuitHalfOpen},
+		{TemplateURL: templateURL, From: CircuitHalfOpen, To: CircuitOpen},
+		{TemplateURL: templateURL, From: CircuitOpen, To: CircuitHalfOpen},
+		{TemplateURL: templateURL, From: CircuitHalfOpen, To: CircuitClosed},
+	}, transitions)
+}
+
+func TestCircuitBreakerFallsBackImmediately(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	breaker := NewCircuitBreaker(1, time.Minute)
+
+	do := func() ([]*Result, error) {
+		optional := newFakeRequestable(server.URL + "/sidebar")
+		optional.optional = true
+		optional.fallback = []byte("fallback")
+
+		r := newRequest()
+		r.CircuitBreaker = breaker
+		r.WithRequestable(optional)
+
+		return r.Do(context.Background())
+	}
+
+	results, err := do()
+	require.NoError(t, err)
+	var resultErr *ResultError
+	require.ErrorAs(t, results[0].FallbackError, &resultErr)
+
+	results, err = do()
+	require.NoError(t, err)
+	require.True(t, results[0].Fallback)
+	require.Equal(t, "fallback", string(results[0].Body))
+	var openErr *CircuitOpenError
+	require.ErrorAs(t, results[0].FallbackError, &openErr)
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+
+	allowed, trial, transition := breaker.allow("/missing")
+	require.True(t, allowed)
+	require.False(t, trial)
+	require.Nil(t, transition)
+
+	require.Nil(t, breaker.record("/missing", false, circuitIgnored))
+	require.Equal(t, CircuitClosed, breaker.State("/missing"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.CircuitBreaker = breaker
+	r.WithRequestable(newFakeRequestable(server.URL + "/missing"))
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, CircuitClosed, breaker.State(server.URL+"/missing"))
+}
+
+func TestCircuitBreakerLimitsHalfOpenRequests(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.HalfOpenRequests = 2
+	breaker.now = func() time.Time { return now }
+
+	allowed, trial, _ := breaker.allow("/sidebar")
+	require.True(t, allowed)
+	require.NotNil(t, breaker.record("/sidebar", trial, circuitFailure))
+
+	now = now.Add(time.Minute)
+	first, firstTrial, transition := breaker.allow("/sidebar")
+	require.True(t, first)
+	require.True(t, firstTrial)
+	require.Equal(t, CircuitHalfOpen, transition.To)
+
+	second, secondTrial, _ := breaker.allow("/sidebar")
+	require.True(t, second)
+	third, _, _ := breaker.allow("/sidebar")
+	require.False(t, third)
+
+	require.Nil(t, breaker.record("/sidebar", firstTrial, circuitSuccess))
+	require.Equal(t, CircuitHalfOpen, breaker.State("/sidebar"))
+	transition = breaker.record("/sidebar", secondTrial, circuitSuccess)
+	require.Equal(t, CircuitClosed, transition.To)
+}
+
+func TestCircuitBreakerAppliesToRevalidation(t *testing.T) {
+	var requests int32
+	var status int32 = http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte("footer"))
+	}))
+	defer server.Close()
+
+	clock := &testClock{now: time.Now()}
+	cache := NewCache(10)
+	cache.now = clock.Now
+	breaker := NewCircuitBreaker(1, time.Minute)
+
+	requestable := newFakeRequestable(server.URL + "/footer")
+	requestable.cacheTTL = time.Minute
+	requestable.swr = time.Hour
+
+	do := func() *Result {
+		r := newRequest()
+		r.Cache = cache
+		r.CircuitBreaker = breaker
+		r.WithRequestable(requestable)
+		results, err := r.Do(context.Background())
+		require.NoError(t, err)
+		return results[0]
+	}
+
+	revalidated := func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return len(cache.revalidating) == 0
+	}
+
+	require.False(t, do().Stale)
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+
+	// The failed refresh is recorded on the breaker and opens the circuit
+	clock.Advance(90 * time.Second)
+	require.True(t, do().Stale)
+	require.Eventually(t, func() bool { return breaker.State(server.URL+"/footer") == CircuitOpen && revalidated() }, time.Second, time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Refreshes are not sent while the circuit is open
+	require.True(t, do().Stale)
+	require.Eventually(t, revalidated, time.Second, time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestCircuitState(t *testing.T) {
+	require.Equal(t, "closed", CircuitClosed.String())
+	require.Equal(t, "open", CircuitOpen.String())
+	require.Equal(t, "half-open", CircuitHalfOpen.String())
+	require.Equal(t, "circuit open for /sidebar", (&CircuitOpenError{TemplateURL: "/sidebar"}).Error())
+}
@@ -0,0 +1,453 @@
+package multiplexer
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache is an in-memory LRU cache of results, keyed by the requestable's URL
+// and the values of the request headers the result varies on.
+//
+// Results are cached for the TTL provided by a CacheableRequestable, or for
+// the `s-maxage` or `max-age` directive of the response's `Cache-Control`
+// header. Responses marked `no-store`, `no-cache`, or `private`, and responses
+// that set cookies, are never cached. The response's `Vary` header is honored,
+// and results always vary on `Accept-Encoding`.
+//
+// Expired results can still be served while they are refreshed in the
+// background, or when the target fails, for the windows provided by a
+// StaleRequestable or the `stale-while-revalidate` and `stale-if-error`
+// directives of the response's `Cache-Control` header.
+type Cache struct {
+	maxEntries int
+	mu         sync.Mutex
+	lru        *list.List
+	entries    map[string]*list.Element
+	keysByURL  map[string]map[string]struct{}
+	// vary headers learned from responses, keyed by URL
+	varyByURL map[string][]string
+	// keys of entries currently being refreshed in the background
+	revalidating map[string]struct{}
+	hits         uint64
+	staleHits    uint64
+	misses       uint64
+	now          func() time.Time
+}
+
+type cacheEntry struct {
+	key       string
+	url       string
+	result    *Result
+	expiresAt time.Time
+	// expired results can be served until these times
+	staleWhileRevalidateUntil time.Time
+	staleIfErrorUntil         time.Time
+}
+
+// removeAt returns the time after which the entry can no longer be served.
+func (e *cacheEntry) removeAt() time.Time {
+	removeAt := e.expiresAt
+
+	if e.staleWhileRevalidateUntil.After(removeAt) {
+		removeAt = e.staleWhileRevalidateUntil
+	}
+
+	if e.staleIfErrorUntil.After(removeAt) {
+		removeAt = e.staleIfErrorUntil
+	}
+
+	return removeAt
+}
+
+type cacheStatus int
+
+const (
+	cacheMiss cacheStatus = iota
+	cacheHit
+	// the result has expired but can be served while it is revalidated
+	cacheStale
+)
+
+// CacheStats contains counters describing the cache's effectiveness.
+type CacheStats struct {
+	Hits uint64
+	// StaleHits counts expired results served while being revalidated, or
+	// because the target failed.
+	StaleHits uint64
+	Misses    uint64
+	Entries   int
+}
+
+// NewCache returns a cache that holds at most maxEntries results, evicting the
+// least recently used result when full.
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		maxEntries:   maxEntries,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+		keysByURL:    make(map[string]map[string]struct{}),
+		varyByURL:    make(map[string][]string),
+		revalidating: make(map[string]struct{}),
+		now:          time.Now,
+	}
+}
+
+// Invalidate removes every cached result for the given URL.
+func (c *Cache) Invalidate(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidateURL(url)
+}
+
+// InvalidatePrefix removes every cached result with a URL starting with prefix.
+func (c *Cache) InvalidatePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for url := range c.keysByURL {
+		if strings.HasPrefix(url, prefix) {
+			c.invalidateURL(url)
+		}
+	}
+}
+
+// Purge removes every cached result.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.keysByURL = make(map[string]map[string]struct{})
+	c.varyByURL = make(map[string][]string)
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits, StaleHits: c.staleHits, Misses: c.misses, Entries: c.lru.Len()}
+}
+
+// get returns a copy of the cached result for the requestable, if present and
+// fresh.
+func (c *Cache) get(requestable Requestable, header http.Header) (*Result, bool) {
+	result, status := c.lookup(requestable, header)
+	if status != cacheHit {
+		return nil, false
+	}
+
+	return result, true
+}
+
+// lookup returns a copy of the cached result for the requestable when it is
+// fresh, or when it has expired but is within its stale-while-revalidate
+// window.
+func (c *Cache) lookup(requestable Requestable, header http.Header) (*Result, cacheStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[c.keyFor(requestable, header)]
+	if !ok {
+		c.misses++
+		return nil, cacheMiss
+	}
+
+	entry := element.Value.(*cacheEntry)
+	now := c.now()
+
+	if !now.Before(entry.removeAt()) {
+		c.remove(element)
+		c.misses++
+		return nil, cacheMiss
+	}
+
+	if now.Before(entry.expiresAt) {
+		c.hits++
+		c.lru.MoveToFront(element)
+		return cachedResult(entry, false), cacheHit
+	}
+
+	if now.Before(entry.staleWhileRevalidateUntil) {
+		c.staleHits++
+		c.lru.MoveToFront(element)
+		return cachedResult(entry, true), cacheStale
+	}
+
+	// Only usable if the target fails
+	c.misses++
+	return nil, cacheMiss
+}
+
+// getStaleIfError returns a copy of the cached result for the requestable if
+// it is within its stale-if-error window, for use when the target fails.
+func (c *Cache) getStaleIfError(requestable Requestable, header http.Header) (*Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[c.keyFor(requestable, header)]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.staleIfErrorUntil) {
+		return nil, false
+	}
+
+	c.staleHits++
+	return cachedResult(entry, !c.now().Before(entry.expiresAt)), true
+}
+
+// startRevalidation returns true if the caller should revalidate the entry for
+// the requestable, or false when it is already being revalidated. The returned
+// key must be passed to finishRevalidation.
+func (c *Cache) startRevalidation(requestable Requestable, header http.Header) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.keyFor(requestable, header)
+	if _, ok := c.revalidating[key]; ok {
+		return "", false
+	}
+
+	c.revalidating[key] = struct{}{}
+	return key, true
+}
+
+func (c *Cache) finishRevalidation(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.revalidating, key)
+}
+
+// keyFor must be called with the lock held.
+func (c *Cache) keyFor(requestable Requestable, header http.Header) string {
+	return cacheKey(requestable.URL(), header, c.varyFor(requestable))
+}
+
+func cachedResult(entry *cacheEntry, stale bool) *Result {
+	result := *entry.result
+	result.Duration = 0
+	result.CacheHit = true
+	result.Stale = stale
+
+	return &result
+}
+
+// set stores the result if the requestable or response allows it to be cached.
+func (c *Cache) set(requestable Requestable, header http.Header, result *Result) {
+	ttl, ok := cacheTTL(requestable, result)
+	if !ok {
+		return
+	}
+	staleWhileRevalidate, staleIfError := staleWindows(requestable, result)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	url := requestable.URL()
+	c.varyByURL[url] = responseVary(result)
+	key := cacheKey(url, header, c.varyFor(requestable))
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	expiresAt := c.now().Add(ttl)
+	entry := &cacheEntry{
+		key:                       key,
+		url:                       url,
+		result:                    result,
+		expiresAt:                 expiresAt,
+		staleWhileRevalidateUntil: expiresAt.Add(staleWhileRevalidate),
+		staleIfErrorUntil:         expiresAt.Add(staleIfError),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	if _, ok := c.keysByURL[url]; !ok {
+		c.keysByURL[url] = make(map[string]struct{})
+	}
+	c.keysByURL[url][key] = struct{}{}
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// varyFor returns the request headers that results for the requestable vary
+// on. Must be called with the lock held.
+func (c *Cache) varyFor(requestable Requestable) []string {
+	// Results keep the Content-Encoding of the response, so they always vary
+	// on Accept-Encoding, even when the target doesn't say so.
+	vary := append([]string{"Accept-Encoding"}, c.varyByURL[requestable.URL()]...)
+
+	if cacheable, ok := requestable.(CacheableRequestable); ok {
+		vary = append(vary, cacheable.CacheVary()...)
+	}
+
+	return vary
+}
+
+// invalidateURL must be called with the lock held.
+func (c *Cache) invalidateURL(url string) {
+	for key := range c.keysByURL[url] {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+	}
+
+	delete(c.varyByURL, url)
+}
+
+// remove must be called with the lock held.
+func (c *Cache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+
+	if keys, ok := c.keysByURL[entry.url]; ok {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.keysByURL, entry.url)
+		}
+	}
+}
+
+func cacheKey(url string, header http.Header, vary []string) string {
+	names := make([]string, 0, len(vary))
+	for _, name := range vary {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteString(url)
+
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(":")
+		key.WriteString(strings.Join(header.Values(name), ","))
+	}
+
+	return key.String()
+}
+
+// cacheTTL returns how long the result can be cached for, preferring the TTL
+// of the requestable over the response's Cache-Control max-age.
+func cacheTTL(requestable Requestable, result *Result) (time.Duration, bool) {
+	if result.Fallback || result.CacheHit {
+		return 0, false
+	}
+
+	for _, vary := range responseVary(result) {
+		if vary == "*" {
+			return 0, false
+		}
+	}
+
+	// Cookies are set for a single user, so responses setting them are never
+	// shared with other requests.
+	if len(result.Header().Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+
+	directives := parseCacheControl(result.Header().Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0, false
+		}
+	}
+
+	if cacheable, ok := requestable.(CacheableRequestable); ok && cacheable.CacheTTL() > 0 {
+		return cacheable.CacheTTL(), true
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+// staleWindows returns how long an expired result can be served while it is
+// revalidated, and when the target fails, preferring the windows of the
+// requestable over the response's Cache-Control header.
+func staleWindows(requestable Requestable, result *Result) (time.Duration, time.Duration) {
+	directives := parseCacheControl(result.Header().Get("Cache-Control"))
+	staleWhileRevalidate := directiveSeconds(directives, "stale-while-revalidate")
+	staleIfError := directiveSeconds(directives, "stale-if-error")
+
+	if stale, ok := requestable.(StaleRequestable); ok {
+		if stale.StaleWhileRevalidate() > 0 {
+			staleWhileRevalidate = stale.StaleWhileRevalidate()
+		}
+
+		if stale.StaleIfError() > 0 {
+			staleIfError = stale.StaleIfError()
+		}
+	}
+
+	return staleWhileRevalidate, staleIfError
+}
+
+func directiveSeconds(directives map[string]string, name string) time.Duration {
+	seconds, err := strconv.Atoi(directives[name])
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func responseVary(result *Result) []string {
+	vary := make([]string, 0)
+
+	for _, value := range result.Header().Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	return vary
+}
+
+// parseCacheControl returns the directives of a Cache-Control header, keyed by
+// their lowercase name.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(directive, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return directives
+}
@@ -0,0 +1,392 @@
+package multiplexer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newCacheResult(url string, header http.Header, body string) *Result {
+	return &Result{
+		Url:          url,
+		Body:         []byte(body),
+		StatusCode:   200,
+		HttpResponse: &http.Response{StatusCode: 200, Header: header},
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	cache := NewCache(10)
+	cache.now = func() time.Time { return now }
+
+	requestable := newFakeRequestable("http://localhost/footer")
+	requestable.cacheTTL = time.Minute
+
+	_, ok := cache.get(requestable, http.Header{})
+	require.False(t, ok)
+
+	cache.set(requestable, http.Header{}, newCacheResult(requestable.URL(), http.Header{}, "footer"))
+
+	result, ok := cache.get(requestable, http.Header{})
+	require.True(t, ok)
+	require.True(t, result.CacheHit)
+	require.Equal(t, "footer", string(result.Body))
+
+	now = now.Add(time.Minute)
+	_, ok = cache.get(requestable, http.Header{})
+	require.False(t, ok)
+
+	require.Equal(t, CacheStats{Hits: 1, Misses: 2, Entries: 0}, cache.Stats())
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := map[string]struct {
+		cacheControl string
+		ttl          time.Duration
+		wantTTL      time.Duration
+		cached       bool
+	}{
+		"no header":                  {cached: false},
+		"max-age":                    {cacheControl: "public, max-age=60", wantTTL: 60 * time.Second, cached: true},
+		"s-maxage preferred":         {cacheControl: "max-age=60, s-maxage=30", wantTTL: 30 * time.Second, cached: true},
+		"private":                    {cacheControl: "private, max-age=60", cached: false},
+		"no-cache":                   {cacheControl: "no-cache", cached: false},
+		"no-store":                   {cacheControl: "no-store", ttl: time.Minute, cached: false},
+		"invalid max-age":            {cacheControl: "max-age=soon", cached: false},
+		"fragment ttl":               {ttl: time.Minute, wantTTL: time.Minute, cached: true},
+		"private over fragment ttl":  {cacheControl: "private", ttl: time.Minute, cached: false},
+		"no-cache over fragment ttl": {cacheControl: "no-cache", ttl: time.Minute, cached: false},
+		"fragment ttl over max-age":  {cacheControl: "max-age=5", ttl: time.Minute, wantTTL: time.Minute, cached: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			requestable := newFakeRequestable("http://localhost/footer")
+			requestable.cacheTTL = test.ttl
+
+			header := http.Header{}
+			if test.cacheControl != "" {
+				header.Set("Cache-Control", test.cacheControl)
+			}
+
+			ttl, cached := cacheTTL(requestable, newCacheResult(requestable.URL(), header, ""))
+			require.Equal(t, test.cached, cached)
+			require.Equal(t, test.wantTTL, ttl)
+		})
+	}
+}
+
+func TestCacheSkipsResponsesSettingCookies(t *testing.T) {
+	cache := NewCache(10)
+
+	requestable := newFakeRequestable("http://localhost/footer")
+	requestable.cacheTTL = time.Minute
+
+	header := http.Header{}
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Set-Cookie", "_session=user1")
+	cache.set(requestable, http.Header{}, newCacheResult(requestable.URL(), header, "footer"))
+
+	_, ok := cache.get(requestable, http.Header{})
+	require.False(t, ok)
+	require.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestCacheVariesOnAcceptEncoding(t *testing.T) {
+	cache := NewCache(10)
+
+	requestable := newFakeRequestable("http://localhost/footer")
+	requestable.cacheTTL = time.Minute
+
+	// The target doesn't send `Vary: Accept-Encoding`
+	header := http.Header{}
+	header.Set("Content-Encoding", "gzip")
+	cache.set(requestable, http.Header{"Accept-Encoding": []string{"gzip"}}, newCacheResult(requestable.URL(), header, "gzipped"))
+
+	result, ok := cache.get(requestable, http.Header{"Accept-Encoding": []string{"gzip"}})
+	require.True(t, ok)
+	require.Equal(t, "gzip", result.Header().Get("Content-Encoding"))
+
+	_, ok = cache.get(requestable, http.Header{})
+	require.False(t, ok)
+}
+
+func TestCacheVary(t *testing.T) {
+	cache := NewCache(10)
+
+	requestable := newFakeRequestable("http://localhost/header")
+	requestable.cacheTTL = time.Minute
+	requestable.cacheVary = []string{"Accept-Language"}
+
+	english := http.Header{"Accept-Language": []string{"en"}}
+	french := http.Header{"Accept-Language": []string{"fr"}}
+	responseHeader := http.Header{"Vary": []string{"X-Theme"}}
+
+	cache.set(requestable, english, newCacheResult(requestable.URL(), responseHeader, "hello"))
+
+	_, ok := cache.get(requestable, french)
+	require.False(t, ok)
+
+	result, ok := cache.get(requestable, english)
+	require.True(t, ok)
+	require.Equal(t, "hello", string(result.Body))
+
+	// The response's Vary header is honored
+	english.Set("X-Theme", "dark")
+	_, ok = cache.get(requestable, english)
+	require.False(t, ok)
+
+	responseHeader.Set("Vary", "*")
+	cache.set(requestable, english, newCacheResult(requestable.URL(), responseHeader, "hello"))
+	_, ok = cache.get(requestable, english)
+	require.False(t, ok)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCache(2)
+
+	requestables := make([]*fakeRequestable, 3)
+	for i, url := range []string{"http://localhost/a", "http://localhost/b", "http://localhost/c"} {
+		requestables[i] = newFakeRequestable(url)
+		requestables[i].cacheTTL = time.Minute
+	}
+
+	cache.set(requestables[0], http.Header{}, newCacheResult(requestables[0].URL(), http.Header{}, "a"))
+	cache.set(requestables[1], http.Header{}, newCacheResult(requestables[1].URL(), http.Header{}, "b"))
+
+	_, ok := cache.get(requestables[0], http.Header{})
+	require.True(t, ok)
+
+	cache.set(requestables[2], http.Header{}, newCacheResult(requestables[2].URL(), http.Header{}, "c"))
+
+	_, ok = cache.get(requestables[1], http.Header{})
+	require.False(t, ok, "expected least recently used entry to be evicted")
+	_, ok = cache.get(requestables[0], http.Header{})
+	require.True(t, ok)
+	_, ok = cache.get(requestables[2], http.Header{})
+	require.True(t, ok)
+	require.Equal(t, 2, cache.Stats().Entries)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	cache := NewCache(10)
+
+	header := newFakeRequestable("http://localhost/header/en")
+	header.cacheTTL = time.Minute
+	header.cacheVary = []string{"Cookie"}
+	footer := newFakeRequestable("http://localhost/footer")
+	footer.cacheTTL = time.Minute
+
+	cache.set(header, http.Header{"Cookie": []string{"a"}}, newCacheResult(header.URL(), http.Header{}, "a"))
+	cache.set(header, http.Header{"Cookie": []string{"b"}}, newCacheResult(header.URL(), http.Header{}, "b"))
+	cache.set(footer, http.Header{}, newCacheResult(footer.URL(), http.Header{}, "footer"))
+	require.Equal(t, 3, cache.Stats().Entries)
+
+	cache.Invalidate(header.URL())
+	require.Equal(t, 1, cache.Stats().Entries)
+	_, ok := cache.get(footer, http.Header{})
+	require.True(t, ok)
+
+	cache.set(header, http.Header{}, newCacheResult(header.URL(), http.Header{}, "a"))
+	cache.InvalidatePrefix("http://localhost/header/")
+	require.Equal(t, 1, cache.Stats().Entries)
+
+	cache.Purge()
+	require.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestRequestDoUsesCache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("footer"))
+	}))
+	defer server.Close()
+
+	cache := NewCache(10)
+
+	for i := 0; i < 3; i++ {
+		r := newRequest()
+		r.Cache = cache
+		r.WithRequestable(newFakeRequestable(server.URL + "/footer"))
+		results, err := r.Do(context.Background())
+
+		require.NoError(t, err)
+		require.Equal(t, "footer", string(results[0].Body))
+		require.Equal(t, i > 0, results[0].CacheHit)
+		require.Equal(t, "public, max-age=60", results[0].Header().Get("Cache-Control"))
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	require.Equal(t, CacheStats{Hits: 2, Misses: 1, Entries: 1}, cache.Stats())
+}
+
+type testClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestStaleWindows(t *testing.T) {
+	requestable := newFakeRequestable("http://localhost/footer")
+	header := http.Header{"Cache-Control": []string{"max-age=60, stale-while-revalidate=30, stale-if-error=600"}}
+	result := newCacheResult(requestable.URL(), header, "")
+
+	swr, sie := staleWindows(requestable, result)
+	require.Equal(t, 30*time.Second, swr)
+	require.Equal(t, 600*time.Second, sie)
+
+	requestable.swr = time.Minute
+	swr, sie = staleWindows(requestable, result)
+	require.Equal(t, time.Minute, swr)
+	require.Equal(t, 600*time.Second, sie)
+}
+
+func TestRequestDoStaleWhileRevalidate(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := atomic.AddInt32(&requests, 1)
+		w.Write([]byte(fmt.Sprintf("v%d", version)))
+	}))
+	defer server.Close()
+
+	clock := &testClock{now: time.Now()}
+	cache := NewCache(10)
+	cache.now = clock.Now
+
+	requestable := newFakeRequestable(server.URL + "/footer")
+	requestable.cacheTTL = time.Minute
+	requestable.swr = time.Minute
+
+	do := func() *Result {
+		r := newRequest()
+		r.Cache = cache
+		r.WithRequestable(requestable)
+		results, err := r.Do(context.Background())
+		require.NoError(t, err)
+		return results[0]
+	}
+
+	require.Equal(t, "v1", string(do().Body))
+
+	clock.Advance(90 * time.Second)
+	result := do()
+	require.Equal(t, "v1", string(result.Body))
+	require.True(t, result.Stale)
+
+	require.Eventually(t, func() bool {
+		result, ok := cache.get(requestable, http.Header{})
+		return ok && string(result.Body) == "v2"
+	}, time.Second, 10*time.Millisecond)
+
+	result = do()
+	require.Equal(t, "v2", string(result.Body))
+	require.False(t, result.Stale)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Once outside of the window, the result is fetched again
+	clock.Advance(3 * time.Minute)
+	require.Equal(t, "v3", string(do().Body))
+}
+
+func TestRequestDoStaleIfError(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=60")
+		w.Write([]byte("footer"))
+	}))
+	defer server.Close()
+
+	clock := &testClock{now: time.Now()}
+	cache := NewCache(10)
+	cache.now = clock.Now
+
+	do := func() (*Result, error) {
+		r := newRequest()
+		r.Cache = cache
+		r.WithRequestable(newFakeRequestable(server.URL + "/footer"))
+		results, err := r.Do(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return results[0], nil
+	}
+
+	_, err := do()
+	require.NoError(t, err)
+
+	clock.Advance(90 * time.Second)
+	result, err := do()
+	require.NoError(t, err)
+	require.Equal(t, "footer", string(result.Body))
+	require.True(t, result.Stale)
+
+	clock.Advance(time.Minute)
+	_, err = do()
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, http.StatusBadGateway, resultErr.Result.StatusCode)
+}
+
+func TestRequestDoStaleIfErrorOnTimeout(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			<-r.Context().Done()
+			return
+		}
+
+		w.Write([]byte("footer"))
+	}))
+	defer server.Close()
+
+	clock := &testClock{now: time.Now()}
+	cache := NewCache(10)
+	cache.now = clock.Now
+
+	requestable := newFakeRequestable(server.URL + "/footer")
+	requestable.cacheTTL = time.Minute
+	requestable.sie = time.Hour
+
+	r := newRequest()
+	r.Cache = cache
+	r.WithRequestable(requestable)
+	_, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	clock.Advance(2 * time.Minute)
+
+	r = newRequest()
+	r.Cache = cache
+	r.Timeout = 50 * time.Millisecond
+	r.WithRequestable(requestable)
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "footer", string(results[0].Body))
+	require.True(t, results[0].Stale)
+}
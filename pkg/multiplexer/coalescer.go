@@ -0,0 +1,161 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Coalescer shares a single fetch between concurrent requests for the same
+// requestable, fanning out the result to each caller.
+//
+// Requests are only coalesced when their URL and the values of the key headers
+// match. The `Cookie` and `Authorization` headers are always key headers, so
+// per-user content is never shared, as is `Accept-Encoding`, so results are
+// only shared with callers that accept their `Content-Encoding`. `Set-Cookie`
+// headers are only returned to the caller whose request made the fetch.
+type Coalescer struct {
+	keyHeaders []string
+	mu         sync.Mutex
+	calls      map[string]*coalescedCall
+	requests   uint64
+	fetches    uint64
+}
+
+type coalescedCall struct {
+	done    chan struct{}
+	result  *Result
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// CoalescerStats contains counters describing how many requests were
+// coalesced.
+type CoalescerStats struct {
+	// Requests counts every request made through the coalescer
+	Requests uint64
+	// Fetches counts the requests that were made to the target
+	Fetches uint64
+}
+
+// CollapseRatio returns the average number of requests served by each fetch.
+func (s CoalescerStats) CollapseRatio() float64 {
+	if s.Fetches == 0 {
+		return 0
+	}
+
+	return float64(s.Requests) / float64(s.Fetches)
+}
+
+// coalescerKeyHeaders are always part of a Coalescer's key. `Cookie` and
+// `Authorization` identify the user, and `Accept-Encoding` determines whether
+// the result is still encoded.
+var coalescerKeyHeaders = []string{"Cookie", "Authorization", "Accept-Encoding"}
+
+// NewCoalescer returns a Coalescer that coalesces requests with the same URL
+// and values for the given headers, along with `Cookie`, `Authorization` and
+// `Accept-Encoding`.
+func NewCoalescer(keyHeaders ...string) *Coalescer {
+	return &Coalescer{
+		keyHeaders: append(append([]string{}, coalescerKeyHeaders...), keyHeaders...),
+		calls:      make(map[string]*coalescedCall),
+	}
+}
+
+func (c *Coalescer) Stats() CoalescerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CoalescerStats{Requests: c.requests, Fetches: c.fetches}
+}
+
+// do calls fetch, or waits for an in-flight fetch with the same key to
+// complete. The fetch is only cancelled once every caller waiting on it has
+// been cancelled. The returned bool is true when the result was shared with
+// another caller's fetch.
+func (c *Coalescer) do(ctx context.Context, requestable Requestable, header http.Header, fetch func(context.Context) (*Result, error)) (*Result, bool, error) {
+	key := cacheKey(requestable.URL(), header, c.keyHeaders)
+
+	c.mu.Lock()
+	c.requests++
+	call, shared := c.calls[key]
+
+	if shared {
+		call.waiters++
+	} else {
+		fetchCtx, cancel := context.WithCancel(detachedContext{parent: ctx})
+		call = &coalescedCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		c.calls[key] = call
+		c.fetches++
+
+		go func() {
+			defer cancel()
+			call.result, call.err = fetch(fetchCtx)
+
+			c.mu.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			c.mu.Unlock()
+
+			close(call.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, shared, call.err
+		}
+
+		if shared {
+			return withoutSetCookie(call.result), shared, nil
+		}
+
+		result := *call.result
+		return &result, shared, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+
+		return nil, shared, ctx.Err()
+	}
+}
+
+// withoutSetCookie returns a copy of the result without its `Set-Cookie`
+// headers, which were meant for the caller that made the fetch.
+func withoutSetCookie(result *Result) *Result {
+	shared := *result
+
+	if result.HttpResponse != nil {
+		response := *result.HttpResponse
+		response.Header = result.HttpResponse.Header.Clone()
+		response.Header.Del("Set-Cookie")
+		shared.HttpResponse = &response
+	}
+
+	return &shared
+}
+
+// detachedContext keeps the values of its parent, but is not cancelled when
+// its parent is, so that a coalesced fetch outlives the caller that started it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,227 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescerSharesConcurrentFetches(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.Write([]byte("header"))
+	}))
+	defer server.Close()
+
+	coalescer := NewCoalescer("Cookie")
+	wg := sync.WaitGroup{}
+	results := make([]*Result, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r := newRequest()
+			r.Coalescer = coalescer
+			r.Header.Set("Cookie", "user=1")
+			r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+			res, err := r.Do(context.Background())
+			require.NoError(t, err)
+			results[i] = res[0]
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 10 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	for _, result := range results {
+		require.Equal(t, "header", string(result.Body))
+	}
+
+	stats := coalescer.Stats()
+	require.Equal(t, CoalescerStats{Requests: 10, Fetches: 1}, stats)
+	require.Equal(t, float64(10), stats.CollapseRatio())
+}
+
+func TestCoalescerKeyHeaders(t *testing.T) {
+	coalescer := NewCoalescer("Cookie")
+	release := make(chan struct{})
+	var fetches int32
+
+	fetch := func(ctx context.Context) (*Result, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &Result{}, nil
+	}
+
+	wg := sync.WaitGroup{}
+	for _, cookie := range []string{"user=1", "user=2", "user=1"} {
+		wg.Add(1)
+		go func(cookie string) {
+			defer wg.Done()
+			_, _, err := coalescer.do(context.Background(), newFakeRequestable("http://localhost/header"), http.Header{"Cookie": []string{cookie}}, fetch)
+			require.NoError(t, err)
+		}(cookie)
+	}
+
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 3 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestCoalescerAlwaysKeysOnUserAndEncodingHeaders(t *testing.T) {
+	coalescer := NewCoalescer()
+	release := make(chan struct{})
+	var fetches int32
+
+	fetch := func(ctx context.Context) (*Result, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &Result{}, nil
+	}
+
+	headers := []http.Header{
+		{"Cookie": []string{"user=1"}},
+		{"Cookie": []string{"user=2"}},
+		{"Authorization": []string{"Bearer 1"}},
+		{"Authorization": []string{"Bearer 2"}},
+		{"Accept-Encoding": []string{"gzip"}},
+	}
+
+	wg := sync.WaitGroup{}
+	for _, header := range headers {
+		wg.Add(1)
+		go func(header http.Header) {
+			defer wg.Done()
+			_, _, err := coalescer.do(context.Background(), newFakeRequestable("http://localhost/header"), header, fetch)
+			require.NoError(t, err)
+		}(header)
+	}
+
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 5 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(5), atomic.LoadInt32(&fetches))
+}
+
+func TestCoalescerOnlyReturnsSetCookieToFetchingCaller(t *testing.T) {
+	coalescer := NewCoalescer()
+	requestable := newFakeRequestable("http://localhost/header")
+	release := make(chan struct{})
+
+	fetch := func(ctx context.Context) (*Result, error) {
+		<-release
+		header := http.Header{}
+		header.Set("Set-Cookie", "_session=user1")
+		header.Set("Content-Type", "text/html")
+		return &Result{HttpResponse: &http.Response{Header: header}}, nil
+	}
+
+	type outcome struct {
+		result *Result
+		shared bool
+	}
+	outcomes := make(chan outcome, 2)
+	do := func() {
+		result, shared, err := coalescer.do(context.Background(), requestable, http.Header{}, fetch)
+		require.NoError(t, err)
+		outcomes <- outcome{result: result, shared: shared}
+	}
+
+	go do()
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 1 }, time.Second, time.Millisecond)
+	go do()
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 2 }, time.Second, time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		outcome := <-outcomes
+		require.Equal(t, "text/html", outcome.result.Header().Get("Content-Type"))
+
+		if outcome.shared {
+			require.Empty(t, outcome.result.Header().Values("Set-Cookie"))
+		} else {
+			require.Equal(t, "_session=user1", outcome.result.Header().Get("Set-Cookie"))
+		}
+	}
+}
+
+func TestCoalescerCancellation(t *testing.T) {
+	coalescer := NewCoalescer()
+	requestable := newFakeRequestable("http://localhost/header")
+	release := make(chan struct{})
+	fetchCancelled := make(chan struct{})
+
+	fetch := func(ctx context.Context) (*Result, error) {
+		select {
+		case <-release:
+			return &Result{Body: []byte("header")}, nil
+		case <-ctx.Done():
+			close(fetchCancelled)
+			return nil, ctx.Err()
+		}
+	}
+
+	// The first caller cancels, but the fetch continues for the second
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, _, err := coalescer.do(firstCtx, requestable, http.Header{}, fetch)
+		firstDone <- err
+	}()
+
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 1 }, time.Second, time.Millisecond)
+
+	secondDone := make(chan *Result)
+	go func() {
+		result, shared, err := coalescer.do(context.Background(), requestable, http.Header{}, fetch)
+		require.NoError(t, err)
+		require.True(t, shared)
+		secondDone <- result
+	}()
+
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 2 }, time.Second, time.Millisecond)
+	cancelFirst()
+	require.ErrorIs(t, <-firstDone, context.Canceled)
+
+	close(release)
+	require.Equal(t, "header", string((<-secondDone).Body))
+
+	// The fetch is cancelled once every caller is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := coalescer.do(ctx, requestable, http.Header{}, func(ctx context.Context) (*Result, error) {
+			<-ctx.Done()
+			close(fetchCancelled)
+			return nil, ctx.Err()
+		})
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool { return coalescer.Stats().Requests == 3 }, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	select {
+	case <-fetchCancelled:
+	case <-time.After(time.Second):
+		require.Fail(t, "expected fetch to be cancelled")
+	}
+}
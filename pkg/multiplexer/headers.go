@@ -63,6 +63,9 @@ func forwardedForFromRequest(req *http.Request) string {
 	return host
 }
 
+// WithDefaultHeaders copies the headers of the first result to the response.
+// viewproxy.Server merges the headers of every fragment instead, see
+// viewproxy.DefaultHeaderMerger.
 func WithDefaultHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		results := ResultsFromContext(r.Context())
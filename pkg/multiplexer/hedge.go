@@ -0,0 +1,212 @@
+package multiplexer
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultHedgeWindow     = 100
+	defaultHedgeMinSamples = 20
+	// the maximum number of hedges that can be saved up while traffic is low
+	maxHedgeTokens = 10
+)
+
+// Hedger sends a second, identical request for requestables that have not
+// responded within a threshold, using whichever response arrives first and
+// cancelling the other. This reduces tail latency caused by a slow target
+// process at the cost of extra load, which is limited by a budget.
+//
+// The threshold is Delay, or when Percentile is set, that percentile of the
+// recent durations of the requestable's template URL.
+type Hedger struct {
+	// The fixed threshold, which is also used until enough durations have been
+	// recorded when Percentile is set. Zero disables hedging until then.
+	Delay time.Duration
+	// The percentile of recent durations used as the threshold, e.g. 0.95.
+	Percentile float64
+	// The number of recent durations kept per template URL. Defaults to 100.
+	Window int
+	// The number of durations needed before Percentile is used. Defaults to
+	// 20.
+	MinSamples int
+	budget     float64
+	mu         sync.Mutex
+	tokens     float64
+	durations  map[string]*hedgeDurations
+}
+
+type hedgeDurations struct {
+	values []time.Duration
+	next   int
+}
+
+// NewHedger returns a Hedger that hedges requests after delay, sending at most
+// budget hedged requests per request, e.g. 0.05 for 5% extra load.
+func NewHedger(delay time.Duration, budget float64) *Hedger {
+	return &Hedger{
+		Delay:     delay,
+		budget:    budget,
+		durations: make(map[string]*hedgeDurations),
+	}
+}
+
+// threshold returns how long to wait before hedging a request for the given
+// template URL, and false when it should not be hedged.
+func (h *Hedger) threshold(templateURL string) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tokens = math.Min(h.tokens+h.budget, maxHedgeTokens)
+
+	if h.Percentile > 0 {
+		if durations, ok := h.durations[templateURL]; ok && len(durations.values) >= h.minSamples() {
+			sorted := make([]time.Duration, len(durations.values))
+			copy(sorted, durations.values)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			index := int(math.Ceil(h.Percentile*float64(len(sorted)))) - 1
+			if index < 0 {
+				index = 0
+			} else if index >= len(sorted) {
+				index = len(sorted) - 1
+			}
+
+			return sorted[index], true
+		}
+	}
+
+	return h.Delay, h.Delay > 0
+}
+
+// allowHedge spends the budget for a hedged request, returning false when the
+// budget is exhausted.
+func (h *Hedger) allowHedge() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tokens < 1 {
+		return false
+	}
+
+	h.tokens--
+	return true
+}
+
+func (h *Hedger) record(templateURL string, duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	durations, ok := h.durations[templateURL]
+	if !ok {
+		durations = &hedgeDurations{}
+		h.durations[templateURL] = durations
+	}
+
+	if len(durations.values) < h.window() {
+		durations.values = append(durations.values, duration)
+	} else {
+		durations.values[durations.next] = duration
+		durations.next = (durations.next + 1) % len(durations.values)
+	}
+}
+
+func (h *Hedger) window() int {
+	if h.Window <= 0 {
+		return defaultHedgeWindow
+	}
+
+	return h.Window
+}
+
+func (h *Hedger) minSamples() int {
+	if h.MinSamples <= 0 {
+		return defaultHedgeMinSamples
+	}
+
+	return h.MinSamples
+}
+
+type hedgeAttempt struct {
+	result *Result
+	err    error
+	hedged bool
+}
+
+// fetchHedged fetches the requestable, sending a hedged request when it has not
+// responded within the request's Hedger threshold. The outcome is recorded on
+// the requestable's span.
+func (r *Request) fetchHedged(ctx context.Context, requestable Requestable) (*Result, error) {
+	if r.Hedger == nil {
+		return r.fetchWithRetries(ctx, requestable)
+	}
+
+	templateURL := requestable.TemplateURL()
+	threshold, ok := r.Hedger.threshold(templateURL)
+	if !ok {
+		result, err := r.fetchWithRetries(ctx, requestable)
+		return r.recordHedgeDuration(templateURL, result, err)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Float64("hedge.threshold_ms", float64(threshold)/float64(time.Millisecond)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	attempts := make(chan hedgeAttempt, 2)
+	fetch := func(hedged bool) {
+		result, err := r.fetchWithRetries(ctx, requestable)
+		attempts <- hedgeAttempt{result: result, err: err, hedged: hedged}
+	}
+
+	go fetch(false)
+
+	timer := time.NewTimer(threshold)
+	defer timer.Stop()
+
+	select {
+	case attempt := <-attempts:
+		span.SetAttributes(attribute.Bool("hedge.sent", false))
+		return r.recordHedgeDuration(templateURL, attempt.result, attempt.err)
+	case <-timer.C:
+	case <-ctx.Done():
+		attempt := <-attempts
+		return attempt.result, attempt.err
+	}
+
+	if !r.Hedger.allowHedge() {
+		span.SetAttributes(attribute.Bool("hedge.sent", false), attribute.Bool("hedge.budget_exhausted", true))
+		attempt := <-attempts
+		return r.recordHedgeDuration(templateURL, attempt.result, attempt.err)
+	}
+
+	span.SetAttributes(attribute.Bool("hedge.sent", true))
+	go fetch(true)
+
+	// The first successful response wins, and the other request is cancelled
+	// when returning. If both fail, the first error is returned.
+	winner := <-attempts
+	if winner.err != nil {
+		if second := <-attempts; second.err == nil {
+			winner = second
+		}
+	}
+
+	span.SetAttributes(attribute.Bool("hedge.won", winner.err == nil && winner.hedged))
+	return r.recordHedgeDuration(templateURL, winner.result, winner.err)
+}
+
+func (r *Request) recordHedgeDuration(templateURL string, result *Result, err error) (*Result, error) {
+	if err == nil {
+		r.Hedger.record(templateURL, result.Duration)
+	}
+
+	return result, err
+}
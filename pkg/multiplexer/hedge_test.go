@@ -0,0 +1,121 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgedRequestWins(t *testing.T) {
+	var requests int32
+	cancelled := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+
+		w.Write([]byte("hedged"))
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	r := newRequest()
+	r.Hedger = NewHedger(20*time.Millisecond, 1)
+	r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "hedged", string(results[0].Body))
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow request was not cancelled")
+	}
+}
+
+func TestHedgingIsNotNeededForFastResponses(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("header"))
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.Hedger = NewHedger(time.Second, 1)
+	r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "header", string(results[0].Body))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestHedgingBudget(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("header"))
+	}))
+	defer server.Close()
+
+	hedger := NewHedger(time.Millisecond, 0.5)
+
+	for i := 0; i < 4; i++ {
+		r := newRequest()
+		r.Hedger = hedger
+		r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+		_, err := r.Do(context.Background())
+		require.NoError(t, err)
+	}
+
+	// Half of the requests can be hedged
+	require.Equal(t, int32(6), atomic.LoadInt32(&requests))
+}
+
+func TestHedgerPercentileThreshold(t *testing.T) {
+	hedger := NewHedger(0, 0)
+	hedger.Percentile = 0.9
+	hedger.MinSamples = 10
+	hedger.Window = 20
+
+	_, ok := hedger.threshold("/header")
+	require.False(t, ok)
+
+	for i := 1; i <= 10; i++ {
+		hedger.record("/header", time.Duration(i)*time.Millisecond)
+	}
+
+	threshold, ok := hedger.threshold("/header")
+	require.True(t, ok)
+	require.Equal(t, 9*time.Millisecond, threshold)
+
+	// Old durations are replaced once the window is full
+	for i := 0; i < 20; i++ {
+		hedger.record("/header", 100*time.Millisecond)
+	}
+
+	threshold, ok = hedger.threshold("/header")
+	require.True(t, ok)
+	require.Equal(t, 100*time.Millisecond, threshold)
+
+	_, ok = hedger.threshold("/footer")
+	require.False(t, ok)
+}
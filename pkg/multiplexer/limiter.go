@@ -0,0 +1,191 @@
+package multiplexer
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// LimitExceededError is returned for requestables that were shed because the
+// Limiter's queue for their host was full.
+type LimitExceededError struct {
+	Host string
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("limiter queue is full for %s", e.Host)
+}
+
+var _ error = &LimitExceededError{}
+
+// Limiter bounds the number of in-flight requests to each target host. When a
+// host is at its limit, requests wait in a bounded queue until a request
+// completes or their context is done, and are shed with a LimitExceededError
+// when the queue is full.
+//
+// Queued requests for a PrioritizedRequestable with a higher priority are sent
+// before those with a lower priority, and requests of the same priority are
+// sent in the order they were queued.
+type Limiter struct {
+	maxInFlight int
+	maxQueue    int
+	mu          sync.Mutex
+	hosts       map[string]*hostLimit
+	shed        uint64
+}
+
+type hostLimit struct {
+	inFlight int
+	queue    limiterQueue
+	queued   uint64
+}
+
+type limiterWaiter struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+	granted  bool
+}
+
+// LimiterStats contains the current state of the limiter across every host.
+type LimiterStats struct {
+	InFlight int
+	Queued   int
+	// Shed counts the requests rejected because a queue was full
+	Shed uint64
+}
+
+// NewLimiter returns a Limiter that allows maxInFlight concurrent requests to
+// each host, with up to maxQueue requests waiting for each host.
+func NewLimiter(maxInFlight int, maxQueue int) *Limiter {
+	return &Limiter{
+		maxInFlight: maxInFlight,
+		maxQueue:    maxQueue,
+		hosts:       make(map[string]*hostLimit),
+	}
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := LimiterStats{Shed: l.shed}
+	for _, host := range l.hosts {
+		stats.InFlight += host.inFlight
+		stats.Queued += len(host.queue)
+	}
+
+	return stats
+}
+
+// acquire waits until a request can be made to the given host, returning a
+// function that must be called once the request completes. The returned bool
+// is true when the request had to wait in the queue.
+func (l *Limiter) acquire(ctx context.Context, host string, priority int) (func(), bool, error) {
+	l.mu.Lock()
+
+	limit, ok := l.hosts[host]
+	if !ok {
+		limit = &hostLimit{}
+		l.hosts[host] = limit
+	}
+
+	release := func() { l.release(host) }
+
+	if limit.inFlight < l.maxInFlight && len(limit.queue) == 0 {
+		limit.inFlight++
+		l.mu.Unlock()
+		return release, false, nil
+	}
+
+	if len(limit.queue) >= l.maxQueue {
+		l.shed++
+		l.mu.Unlock()
+		return nil, false, &LimitExceededError{Host: host}
+	}
+
+	waiter := &limiterWaiter{priority: priority, seq: limit.queued, ready: make(chan struct{})}
+	limit.queued++
+	heap.Push(&limit.queue, waiter)
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return release, true, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// The waiter may have been granted a slot while the context was
+		// finishing, in which case the slot is passed on.
+		if waiter.granted {
+			l.releaseLocked(host)
+		} else {
+			heap.Remove(&limit.queue, waiter.index)
+		}
+
+		return nil, true, ctx.Err()
+	}
+}
+
+func (l *Limiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseLocked(host)
+}
+
+// releaseLocked hands the completed request's slot to the next queued
+// request, or frees it when the queue is empty.
+func (l *Limiter) releaseLocked(host string) {
+	limit := l.hosts[host]
+
+	if len(limit.queue) == 0 {
+		limit.inFlight--
+
+		if limit.inFlight == 0 {
+			delete(l.hosts, host)
+		}
+		return
+	}
+
+	waiter := heap.Pop(&limit.queue).(*limiterWaiter)
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+// limiterQueue is a heap of waiters ordered by priority, then by the order
+// they were queued in.
+type limiterQueue []*limiterWaiter
+
+func (q limiterQueue) Len() int { return len(q) }
+
+func (q limiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q limiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *limiterQueue) Push(x interface{}) {
+	waiter := x.(*limiterWaiter)
+	waiter.index = len(*q)
+	*q = append(*q, waiter)
+}
+
+func (q *limiterQueue) Pop() interface{} {
+	old := *q
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return waiter
+}
@@ -0,0 +1,159 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterBoundsInFlightRequests(t *testing.T) {
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	limiter := NewLimiter(2, 10)
+
+	r := newRequest()
+	r.Limiter = limiter
+	for i := 0; i < 6; i++ {
+		r.WithRequestable(newFakeRequestable(server.URL + "/fragment"))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		results, err := r.Do(context.Background())
+		require.NoError(t, err)
+		require.Len(t, results, 6)
+	}()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&inFlight) == 2 }, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return limiter.Stats() == LimiterStats{InFlight: 2, Queued: 4} }, time.Second, time.Millisecond)
+	close(release)
+	<-done
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+	require.Equal(t, LimiterStats{}, limiter.Stats())
+}
+
+func TestLimiterShedsWhenQueueIsFull(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	limiter := NewLimiter(1, 1)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newRequest()
+			r.Limiter = limiter
+			r.WithRequestable(newFakeRequestable(server.URL + "/fragment"))
+			r.Do(context.Background())
+		}()
+	}
+	require.Eventually(t, func() bool { return limiter.Stats() == LimiterStats{InFlight: 1, Queued: 1} }, time.Second, time.Millisecond)
+
+	optional := newFakeRequestable(server.URL + "/optional")
+	optional.optional = true
+	optional.fallback = []byte("fallback")
+
+	r := newRequest()
+	r.Limiter = limiter
+	r.WithRequestable(optional)
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.True(t, results[0].Fallback)
+	var limitErr *LimitExceededError
+	require.ErrorAs(t, results[0].FallbackError, &limitErr)
+	require.Equal(t, uint64(1), limiter.Stats().Shed)
+
+	r = newRequest()
+	r.Limiter = limiter
+	r.WithRequestable(newFakeRequestable(server.URL + "/required"))
+	_, err = r.Do(context.Background())
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, "limiter queue is full for "+server.Listener.Addr().String(), err.Error())
+
+	release <- struct{}{}
+	release <- struct{}{}
+	wg.Wait()
+}
+
+func TestLimiterQueueTimesOut(t *testing.T) {
+	limiter := NewLimiter(1, 1)
+	release, queued, err := limiter.acquire(context.Background(), "localhost", 0)
+	require.NoError(t, err)
+	require.False(t, queued)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, queued, err = limiter.acquire(ctx, "localhost", 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, queued)
+	require.Equal(t, LimiterStats{InFlight: 1}, limiter.Stats())
+
+	release()
+	require.Equal(t, LimiterStats{}, limiter.Stats())
+}
+
+func TestLimiterPriority(t *testing.T) {
+	limiter := NewLimiter(1, 10)
+	release, _, err := limiter.acquire(context.Background(), "localhost", 0)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+
+	for i, priority := range []int{0, 1, 0, 2} {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			release, _, err := limiter.acquire(context.Background(), "localhost", priority)
+			require.NoError(t, err)
+
+			mu.Lock()
+			order = append(order, priority)
+			mu.Unlock()
+			release()
+		}(priority)
+
+		require.Eventually(t, func() bool { return limiter.Stats().Queued == i+1 }, time.Second, time.Millisecond)
+	}
+
+	release()
+	wg.Wait()
+
+	require.Equal(t, []int{2, 1, 0, 0}, order)
+}
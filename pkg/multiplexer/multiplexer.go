@@ -3,29 +3,35 @@ package multiplexer
 import (
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"sync"
 	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
+	"github.com/blakewilliams/viewproxy/pkg/signing"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
 type TimeoutError struct {
-	inner error
+	// TemplateURL is set when a single requestable exceeded its own timeout,
+	// and is empty when the request as a whole timed out.
+	TemplateURL string
+	inner       error
 }
 
 func (et *TimeoutError) Error() string {
+	if et.TemplateURL != "" {
+		return fmt.Sprintf("multiplexer timed out fetching %s: %s", et.TemplateURL, et.inner)
+	}
+
 	return fmt.Sprintf("multiplexer timed out: %s", et.inner)
 }
 
@@ -39,6 +45,10 @@ func newTimeoutError(inner error) *TimeoutError {
 	return &TimeoutError{inner: inner}
 }
 
+func newRequestableTimeoutError(templateURL string, inner error) *TimeoutError {
+	return &TimeoutError{TemplateURL: templateURL, inner: inner}
+}
+
 type Request struct {
 	ctx          context.Context
 	Header       http.Header
@@ -48,6 +58,38 @@ type Request struct {
 	Non2xxErrors bool
 	Tripper      Tripper
 	SecretFilter secretfilter.Filter
+	// Signer, when set, signs requests instead of HmacSecret. It allows
+	// multiple keys and the v2 signing scheme.
+	Signer *signing.Signer
+	// Cache, when set, is checked before making requests to the target and
+	// stores results that are cacheable.
+	Cache *Cache
+	// Coalescer, when set, shares a single fetch between concurrent requests
+	// for the same requestable.
+	Coalescer *Coalescer
+	// RetryPolicy, when set, retries requestables that fail with a transient
+	// error. Requestables can override it by implementing
+	// RetryableRequestable.
+	RetryPolicy *RetryPolicy
+	// Limiter, when set, bounds the number of concurrent requests to each
+	// target host.
+	Limiter *Limiter
+	// Hedger, when set, sends a second request for requestables that are slow
+	// to respond, using whichever response arrives first.
+	Hedger *Hedger
+	// CircuitBreaker, when set, fails requestables immediately with a
+	// CircuitOpenError while their template URL is failing.
+	CircuitBreaker *CircuitBreaker
+	// OnCircuitStateChange is called when a request changes the state of a
+	// circuit in the CircuitBreaker.
+	OnCircuitStateChange func(transition *CircuitTransition)
+	// AcceptStatus, when set, is called for non-2xx responses when
+	// Non2xxErrors is true. Returning true returns the response as a result
+	// instead of a ResultError.
+	AcceptStatus func(requestable Requestable, statusCode int) bool
+	// SpanAttributes are added to the spans of the request and each
+	// requestable.
+	SpanAttributes []attribute.KeyValue
 }
 
 func NewRequest(tripper Tripper) *Request {
@@ -59,6 +101,7 @@ func NewRequest(tripper Tripper) *Request {
 		Non2xxErrors: true,
 		Header:       http.Header{},
 		Tripper:      tripper,
+		SecretFilter: secretfilter.New(),
 	}
 }
 
@@ -74,64 +117,501 @@ func (r *Request) WithRequestable(requestable Requestable) {
 	r.requestables = append(r.requestables, requestable)
 }
 
+// Do fetches every requestable, returning the results in the order the
+// requestables were added. If a requestable without a fallback fails, the
+// remaining requests are cancelled and the error is returned.
 func (r *Request) Do(ctx context.Context) ([]*Result, error) {
+	results := make([]*Result, len(r.requestables))
+
+	err := r.DoEach(ctx, func(i int, requestable Requestable, result *Result, err error) {
+		if err != nil {
+			return
+		}
+
+		results[i] = result
+	})
+
+	if err != nil {
+		return make([]*Result, 0), err
+	}
+
+	return results, nil
+}
+
+// StreamResult is the outcome of a single requestable, yielded by Stream.
+type StreamResult struct {
+	// Index matches the order requestables were added in
+	Index       int
+	Requestable Requestable
+	Result      *Result
+	Err         error
+}
+
+// Stream fetches every requestable, yielding each outcome on the returned
+// channel as it completes. It has the same semantics as DoEach, and the
+// channel is closed once the request is complete or has failed. The channel is
+// buffered, so the caller can stop receiving at any time.
+func (r *Request) Stream(ctx context.Context) <-chan StreamResult {
+	stream := make(chan StreamResult, len(r.requestables))
+
+	go func() {
+		defer close(stream)
+
+		r.DoEach(ctx, func(i int, requestable Requestable, result *Result, err error) {
+			stream <- StreamResult{Index: i, Requestable: requestable, Result: result, Err: err}
+		})
+	}()
+
+	return stream
+}
+
+// Collect fetches every requestable like Do, but returns the outcome of every
+// requestable even when the request fails, including requestables that were
+// cancelled because another requestable failed. fn, when not nil, is called
+// with each outcome as it completes, as in DoEach.
+func (r *Request) Collect(ctx context.Context, fn func(outcome *RequestableResult)) ([]*RequestableResult, error) {
+	start := time.Now()
+	outcomes := make([]*RequestableResult, len(r.requestables))
+
+	err := r.DoEach(ctx, func(i int, requestable Requestable, result *Result, err error) {
+		outcomes[i] = newRequestableResult(i, requestable, time.Since(start))
+		outcomes[i].Result = result
+		outcomes[i].Err = err
+
+		if fn != nil {
+			fn(outcomes[i])
+		}
+	})
+
+	var timeoutErr *TimeoutError
+	timedOut := errors.As(err, &timeoutErr)
+
+	for i, requestable := range r.requestables {
+		if outcomes[i] != nil {
+			continue
+		}
+
+		outcomes[i] = newRequestableResult(i, requestable, time.Since(start))
+		if timedOut {
+			outcomes[i].Err = err
+		} else {
+			outcomes[i].Err = context.Canceled
+			outcomes[i].Cancelled = true
+		}
+	}
+
+	return outcomes, err
+}
+
+func newRequestableResult(index int, requestable Requestable, duration time.Duration) *RequestableResult {
+	outcome := &RequestableResult{Index: index, Requestable: requestable, Duration: duration}
+	if keyed, ok := requestable.(KeyedRequestable); ok {
+		outcome.Key = keyed.Key()
+	}
+
+	return outcome
+}
+
+// DoEach fetches every requestable, calling fn as each one completes,
+// including requestables that used their fallback. Calls are serialized and fn
+// is not called after DoEach returns.
+//
+// If a requestable without a fallback fails, fn is called with its error and
+// with any requestables that have already completed, the remaining requests
+// are cancelled, and the error is returned. When the
+// request times out, fn is called for the remaining requestables that have a
+// stale cached result or fallback, until one without either is found, which
+// fails the request with a TimeoutError.
+func (r *Request) DoEach(ctx context.Context, fn func(index int, requestable Requestable, result *Result, err error)) error {
 	tracer := otel.Tracer("multiplexer")
 	var span trace.Span
-	ctx, span = tracer.Start(ctx, "fetch_urls")
+	ctx, span = tracer.Start(ctx, "fetch_urls", trace.WithAttributes(r.SpanAttributes...))
 	defer span.End()
 
 	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
 	defer cancel()
 
 	reqCount := len(r.requestables)
-	wg := sync.WaitGroup{}
-	wg.Add(reqCount)
-	errCh := make(chan error, reqCount)
-	results := make([]*Result, reqCount)
+	// buffered so that requests completing after DoEach returns don't block
+	completions := make(chan StreamResult, reqCount)
 
 	for i, f := range r.requestables {
 		reqCtx := context.WithValue(ctx, RequestableContextKey{}, f)
 
-		go func(ctx context.Context, requestable Requestable, i int, wg *sync.WaitGroup) {
-			defer wg.Done()
-			var span trace.Span
-			ctx, span = tracer.Start(ctx, "fetch_url")
-			for key, value := range requestable.Metadata() {
-				span.SetAttributes(attribute.String(key, value))
+		go func(ctx context.Context, requestable Requestable, i int) {
+			result, err := r.fetchRequestable(ctx, requestable)
+			completions <- StreamResult{Index: i, Requestable: requestable, Result: result, Err: err}
+		}(reqCtx, f, i)
+	}
+
+	completed := make([]bool, reqCount)
+	complete := func(completion StreamResult) error {
+		completed[completion.Index] = true
+		fn(completion.Index, completion.Requestable, completion.Result, completion.Err)
+
+		return completion.Err
+	}
+
+	// drain completes the requestables that have already completed, so they
+	// keep their results instead of being treated as cancelled or timed out.
+	drain := func() error {
+		var drainErr error
+
+		for {
+			select {
+			case completion := <-completions:
+				if err := complete(completion); err != nil && drainErr == nil {
+					drainErr = err
+				}
+			default:
+				return drainErr
 			}
-			defer span.End()
+		}
+	}
 
-			headersForRequest := r.Header
-			if r.HmacSecret != "" {
-				headersForRequest = r.headersWithHmac(requestable.URL())
+	for remaining := reqCount; remaining > 0; remaining-- {
+		select {
+		case completion := <-completions:
+			if err := complete(completion); err != nil {
+				drain()
+				return err
 			}
+		case <-ctx.Done():
+			if err := drain(); err != nil {
+				return err
+			}
+
+			timeoutErr := newTimeoutError(ctx.Err())
+
+			for i, requestable := range r.requestables {
+				if completed[i] {
+					continue
+				}
 
-			result, err := r.fetchUrl(ctx, "GET", requestable, headersForRequest, nil)
+				result, ok := r.staleIfError(requestable, timeoutErr)
+				if !ok {
+					result = fallbackResult(requestable, timeoutErr)
+				}
 
-			if err != nil {
-				errCh <- r.filterError(requestable.TemplateURL(), err)
+				if result == nil {
+					fn(i, requestable, nil, timeoutErr)
+					return timeoutErr
+				}
+
+				fn(i, requestable, result, nil)
 			}
 
-			results[i] = result
-		}(reqCtx, f, i, &wg)
+			return nil
+		}
 	}
 
-	// wait for all responses to complete
-	done := make(chan struct{})
-	go (func(wg *sync.WaitGroup) {
-		defer close(done)
-		wg.Wait()
-	})(&wg)
+	return nil
+}
 
-	select {
-	case err := <-errCh:
-		cancel()
-		return make([]*Result, 0), err
-	case <-done:
-		return results, nil
-	case <-ctx.Done():
-		return make([]*Result, 0), newTimeoutError(ctx.Err())
+// fetchRequestable fetches a single requestable within its own span, returning
+// its fallback result when it fails and has one.
+func (r *Request) fetchRequestable(ctx context.Context, requestable Requestable) (*Result, error) {
+	var span trace.Span
+	ctx, span = otel.Tracer("multiplexer").Start(ctx, "fetch_url", trace.WithAttributes(r.SpanAttributes...))
+	for key, value := range requestable.Metadata() {
+		span.SetAttributes(attribute.String(key, value))
+	}
+	span.SetAttributes(attribute.String("template_url", r.SecretFilter.FilterURLString(requestable.TemplateURL())))
+	if keyed, ok := requestable.(KeyedRequestable); ok {
+		span.SetAttributes(attribute.String("fragment_key", keyed.Key()))
+	}
+	defer span.End()
+
+	fetchCtx := ctx
+	if timeoutable, ok := requestable.(TimeoutRequestable); ok && timeoutable.Timeout() > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, timeoutable.Timeout())
+		defer cancel()
+	}
+
+	result, err := r.fetchCached(fetchCtx, requestable)
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = newTimeoutError(ctx.Err())
+		} else if fetchCtx.Err() == context.DeadlineExceeded {
+			safeUrl := r.SecretFilter.FilterURLString(requestable.TemplateURL())
+			err = newRequestableTimeoutError(safeUrl, fetchCtx.Err())
+		}
+		err = r.filterError(requestable.TemplateURL(), err)
+
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) {
+			span.SetAttributes(attribute.Int("http.status_code", resultErr.Result.StatusCode))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		fallback := fallbackResult(requestable, err)
+		if fallback == nil {
+			return nil, err
+		}
+
+		span.SetAttributes(attribute.Bool("fallback", true))
+		return fallback, nil
+	}
+
+	span.SetAttributes(
+		attribute.Int("http.status_code", result.StatusCode),
+		attribute.Int("http.response_content_length", len(result.Body)),
+	)
+
+	return result, nil
+}
+
+// fetchCached returns the result from the request's Cache when possible,
+// otherwise it fetches the requestable and stores the result in the Cache.
+func (r *Request) fetchCached(ctx context.Context, requestable Requestable) (*Result, error) {
+	if r.Cache == nil {
+		return r.fetchCoalesced(ctx, requestable)
+	}
+
+	span := trace.SpanFromContext(ctx)
+
+	result, status := r.Cache.lookup(requestable, r.Header)
+	switch status {
+	case cacheHit:
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return result, nil
+	case cacheStale:
+		span.SetAttributes(attribute.Bool("cache.hit", true), attribute.Bool("cache.stale", true))
+		if key, ok := r.Cache.startRevalidation(requestable, r.Header); ok {
+			go r.revalidate(ctx, key, requestable)
+		}
+		return result, nil
+	}
+
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+	result, err := r.fetchCoalesced(ctx, requestable)
+
+	if err != nil {
+		if stale, ok := r.staleIfError(requestable, err); ok {
+			span.SetAttributes(attribute.Bool("cache.stale", true))
+			span.RecordError(err)
+			return stale, nil
+		}
+
+		return nil, err
+	}
+
+	r.Cache.set(requestable, r.Header, result)
+	return result, nil
+}
+
+// fetchCoalesced fetches the requestable, sharing the fetch with concurrent
+// requests for the same requestable when the request has a Coalescer.
+func (r *Request) fetchCoalesced(ctx context.Context, requestable Requestable) (*Result, error) {
+	if r.Coalescer == nil {
+		return r.fetchWithCircuitBreaker(ctx, requestable)
+	}
+
+	result, shared, err := r.Coalescer.do(ctx, requestable, r.Header, func(ctx context.Context) (*Result, error) {
+		return r.fetchWithCircuitBreaker(ctx, requestable)
+	})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("coalesced", shared))
+
+	return result, err
+}
+
+// fetchWithCircuitBreaker fetches the requestable unless its circuit is open,
+// recording the outcome in the request's CircuitBreaker.
+func (r *Request) fetchWithCircuitBreaker(ctx context.Context, requestable Requestable) (*Result, error) {
+	return r.throughCircuitBreaker(ctx, requestable, r.fetchHedged)
+}
+
+// throughCircuitBreaker calls fetch unless the requestable's circuit is open,
+// recording the outcome on the request's CircuitBreaker.
+func (r *Request) throughCircuitBreaker(ctx context.Context, requestable Requestable, fetch func(context.Context, Requestable) (*Result, error)) (*Result, error) {
+	if r.CircuitBreaker == nil {
+		return fetch(ctx, requestable)
 	}
+
+	templateURL := requestable.TemplateURL()
+	span := trace.SpanFromContext(ctx)
+
+	allowed, trial, transition := r.CircuitBreaker.allow(templateURL)
+	r.circuitStateChanged(span, transition)
+
+	if !allowed {
+		span.SetAttributes(attribute.String("circuit_breaker.state", CircuitOpen.String()))
+		return nil, &CircuitOpenError{TemplateURL: r.SecretFilter.FilterURLString(templateURL)}
+	}
+
+	result, err := fetch(ctx, requestable)
+
+	outcome := circuitSuccess
+	var resultErr *ResultError
+	var limitErr *LimitExceededError
+	if errors.As(err, &resultErr) {
+		if resultErr.Result.StatusCode >= 500 {
+			outcome = circuitFailure
+		}
+	} else if errors.Is(ctx.Err(), context.Canceled) || errors.As(err, &limitErr) {
+		outcome = circuitIgnored
+	} else if err != nil || result.StatusCode >= 500 {
+		outcome = circuitFailure
+	}
+
+	r.circuitStateChanged(span, r.CircuitBreaker.record(templateURL, trial, outcome))
+
+	return result, err
+}
+
+// fetchWithRetries fetches the requestable, retrying failed attempts according
+// to its RetryPolicy. Each retry is traced as its own span.
+func (r *Request) fetchWithRetries(ctx context.Context, requestable Requestable) (*Result, error) {
+	policy := r.retryPolicyFor(requestable)
+	if policy == nil || policy.MaxAttempts < 2 {
+		return r.fetchAttempt(ctx, requestable)
+	}
+
+	tracer := otel.Tracer("multiplexer")
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, span := tracer.Start(ctx, "fetch_attempt", trace.WithAttributes(attribute.Int("attempt", attempt)))
+		result, err := r.fetchAttempt(attemptCtx, requestable)
+
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) {
+			span.SetAttributes(attribute.Int("http.status_code", resultErr.Result.StatusCode))
+		} else if err == nil {
+			span.SetAttributes(attribute.Int("http.status_code", result.StatusCode))
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		if (err == nil && !policy.retriesStatus(result.StatusCode)) || attempt >= policy.MaxAttempts {
+			return result, err
+		}
+
+		delay, ok := policy.retryDelay(ctx, attempt, result, err)
+		if !ok {
+			return result, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+	}
+}
+
+// fetchAttempt makes a single request for the requestable, which fetchUrl
+// signs with a fresh HMAC when the requestable's target requires one.
+func (r *Request) fetchAttempt(ctx context.Context, requestable Requestable) (*Result, error) {
+	if r.Limiter != nil {
+		release, err := r.acquireLimiter(ctx, requestable)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	return r.fetchUrl(ctx, "GET", requestable, r.Header, nil)
+}
+
+// acquireLimiter waits for the request's Limiter to allow a request to the
+// requestable's host, recording the time spent queued on the current span.
+func (r *Request) acquireLimiter(ctx context.Context, requestable Requestable) (func(), error) {
+	requestURL, err := url.Parse(requestable.URL())
+	if err != nil {
+		return nil, err
+	}
+
+	priority := 0
+	if prioritized, ok := requestable.(PrioritizedRequestable); ok {
+		priority = prioritized.Priority()
+	}
+
+	start := time.Now()
+	release, queued, err := r.Limiter.acquire(ctx, requestURL.Host, priority)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("limiter.queued", queued))
+	if queued {
+		span.SetAttributes(attribute.Float64("limiter.wait_ms", float64(time.Since(start))/float64(time.Millisecond)))
+	}
+
+	return release, err
+}
+
+func (r *Request) retryPolicyFor(requestable Requestable) *RetryPolicy {
+	if retryable, ok := requestable.(RetryableRequestable); ok && retryable.RetryPolicy() != nil {
+		return retryable.RetryPolicy()
+	}
+
+	return r.RetryPolicy
+}
+
+func (r *Request) circuitStateChanged(span trace.Span, transition *CircuitTransition) {
+	if transition == nil {
+		return
+	}
+
+	span.AddEvent("circuit_breaker.state_change", trace.WithAttributes(
+		attribute.String("circuit_breaker.from", transition.From.String()),
+		attribute.String("circuit_breaker.to", transition.To.String()),
+	))
+
+	if r.OnCircuitStateChange != nil {
+		r.OnCircuitStateChange(transition)
+	}
+}
+
+// staleIfError returns the cached result for the requestable when the target
+// failed with a 5xx status, a timeout, or a connection error, and the result is
+// within its stale-if-error window.
+func (r *Request) staleIfError(requestable Requestable, err error) (*Result, bool) {
+	if r.Cache == nil {
+		return nil, false
+	}
+
+	var resultErr *ResultError
+	if errors.As(err, &resultErr) && resultErr.Result.StatusCode < 500 {
+		return nil, false
+	}
+
+	return r.Cache.getStaleIfError(requestable, r.Header)
+}
+
+// revalidate refreshes the cached result for the requestable in the background.
+func (r *Request) revalidate(ctx context.Context, key string, requestable Requestable) {
+	defer r.Cache.finishRevalidation(key)
+
+	// The revalidation outlives the request, so it is linked to the request's
+	// span instead of being a child of it.
+	revalidateCtx := context.WithValue(context.Background(), RequestableContextKey{}, requestable)
+	revalidateCtx, cancel := context.WithTimeout(revalidateCtx, r.Timeout)
+	defer cancel()
+
+	revalidateCtx, span := otel.Tracer("multiplexer").Start(
+		revalidateCtx,
+		"revalidate_url",
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+	)
+	defer span.End()
+
+	// Refreshes go through the circuit breaker so that they don't keep
+	// hitting a failing target, and so their outcomes are recorded.
+	result, err := r.throughCircuitBreaker(revalidateCtx, requestable, r.fetchWithRetries)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+
+	r.Cache.set(requestable, r.Header, result)
 }
 
 func (r *Request) fetchUrl(ctx context.Context, method string, requestable Requestable, headers http.Header, body io.ReadCloser) (*Result, error) {
@@ -149,7 +629,15 @@ func (r *Request) fetchUrl(ctx context.Context, method string, requestable Reque
 		}
 	}
 
-	resp, err := r.Tripper.Request(req)
+	if signer := r.signerFor(requestable); signer != nil {
+		if err := signer.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := r.tripperFor(requestable).Request(req)
 
 	if err != nil {
 		return nil, err
@@ -188,30 +676,52 @@ func (r *Request) fetchUrl(ctx context.Context, method string, requestable Reque
 		StatusCode:   resp.StatusCode,
 	}
 
-	if r.Non2xxErrors && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+	if r.Non2xxErrors && (resp.StatusCode < 200 || resp.StatusCode > 299) && !r.acceptsStatus(requestable, resp.StatusCode) {
 		return nil, newResultError(requestable.TemplateURL(), r, result)
 	}
 
 	return result, nil
 }
 
-func (r *Request) headersWithHmac(url string) http.Header {
-	newHeaders := http.Header{}
-	for name, value := range r.Header {
-		newHeaders[name] = value
+func (r *Request) acceptsStatus(requestable Requestable, statusCode int) bool {
+	return r.AcceptStatus != nil && r.AcceptStatus(requestable, statusCode)
+}
+
+// backendFor returns the backend of the given requestable, or nil if it uses
+// the request's default target.
+func backendFor(requestable Requestable) *Backend {
+	if backendRequestable, ok := requestable.(BackendRequestable); ok {
+		return backendRequestable.Backend()
 	}
 
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	return nil
+}
 
-	mac := hmac.New(sha256.New, []byte(r.HmacSecret))
-	mac.Write(
-		[]byte(fmt.Sprintf("%s,%s", pathFromFullUrl(url), timestamp)),
-	)
+// signerFor returns the signer for the requestable's target, or nil when
+// requests to it are not signed. HmacSecret uses the legacy signing scheme.
+func (r *Request) signerFor(requestable Requestable) *signing.Signer {
+	signer, secret := r.Signer, r.HmacSecret
+	if backend := backendFor(requestable); backend != nil {
+		signer, secret = backend.Signer, backend.HmacSecret
+	}
 
-	newHeaders.Set("Authorization", hex.EncodeToString(mac.Sum(nil)))
-	newHeaders.Set("X-Authorization-Time", timestamp)
+	if signer != nil {
+		return signer
+	}
+
+	if secret != "" {
+		return signing.NewSigner(secret)
+	}
+
+	return nil
+}
+
+func (r *Request) tripperFor(requestable Requestable) Tripper {
+	if backend := backendFor(requestable); backend != nil && backend.Tripper != nil {
+		return backend.Tripper
+	}
 
-	return newHeaders
+	return r.Tripper
 }
 
 func (r *Request) filterError(errURL string, err error) error {
@@ -222,13 +732,3 @@ func (r *Request) filterError(errURL string, err error) error {
 
 	return err
 }
-
-func pathFromFullUrl(fullUrl string) string {
-	targetUrl, _ := url.Parse(fullUrl)
-
-	if targetUrl.RawQuery != "" {
-		return fmt.Sprintf("%s?%s", targetUrl.Path, targetUrl.RawQuery)
-	} else {
-		return targetUrl.Path
-	}
-}
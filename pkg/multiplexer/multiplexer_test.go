@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -18,16 +19,38 @@ var defaultTimeout = time.Duration(5) * time.Second
 type fakeRequestable struct {
 	templateURL string
 	url         string
+	optional    bool
+	fallback    []byte
+	timeout     time.Duration
+	cacheTTL    time.Duration
+	cacheVary   []string
+	swr         time.Duration
+	sie         time.Duration
+	retryPolicy *RetryPolicy
 }
 
 func (ff *fakeRequestable) URL() string                 { return ff.url }
 func (ff *fakeRequestable) TemplateURL() string         { return ff.templateURL }
 func (ff *fakeRequestable) Metadata() map[string]string { return make(map[string]string) }
+func (ff *fakeRequestable) Fallback() ([]byte, bool)    { return ff.fallback, ff.optional }
+func (ff *fakeRequestable) Timeout() time.Duration      { return ff.timeout }
+func (ff *fakeRequestable) CacheTTL() time.Duration     { return ff.cacheTTL }
+func (ff *fakeRequestable) CacheVary() []string         { return ff.cacheVary }
+func (ff *fakeRequestable) RetryPolicy() *RetryPolicy   { return ff.retryPolicy }
+
+func (ff *fakeRequestable) StaleWhileRevalidate() time.Duration { return ff.swr }
+func (ff *fakeRequestable) StaleIfError() time.Duration         { return ff.sie }
+
 func newFakeRequestable(url string) *fakeRequestable {
 	return &fakeRequestable{url: url, templateURL: url}
 }
 
 var _ Requestable = &fakeRequestable{}
+var _ FallbackRequestable = &fakeRequestable{}
+var _ TimeoutRequestable = &fakeRequestable{}
+var _ CacheableRequestable = &fakeRequestable{}
+var _ StaleRequestable = &fakeRequestable{}
+var _ RetryableRequestable = &fakeRequestable{}
 
 func TestRequestDoReturnsMultipleResponsesInOrder(t *testing.T) {
 	server := startServer(t)
@@ -164,6 +187,55 @@ func TestFetchTimeout(t *testing.T) {
 	server.Close()
 }
 
+func TestFetchRequestableTimeout(t *testing.T) {
+	server := startServer(t)
+	start := time.Now()
+
+	slow := newFakeRequestable("http://localhost:9990?fragment=slow&secret=1")
+	slow.templateURL = "http://localhost:9990/slow?secret=1"
+	slow.timeout = time.Duration(50) * time.Millisecond
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(slow)
+	r.Timeout = defaultTimeout
+	_, err := r.Do(context.Background())
+	duration := time.Since(start)
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, "http://localhost:9990/slow?secret=FILTERED", timeoutErr.TemplateURL)
+	require.EqualError(t, err, "multiplexer timed out fetching http://localhost:9990/slow?secret=FILTERED: context deadline exceeded")
+	require.Less(t, duration, time.Duration(1)*time.Second)
+
+	server.Close()
+}
+
+func TestOptionalRequestableFallsBackOnRequestableTimeout(t *testing.T) {
+	server := startServer(t)
+
+	slow := newFakeRequestable("http://localhost:9990?fragment=slow")
+	slow.timeout = time.Duration(50) * time.Millisecond
+	slow.optional = true
+	slow.fallback = []byte("too slow")
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(slow)
+	r.Timeout = defaultTimeout
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "<body>", string(results[0].Body))
+	require.Equal(t, "too slow", string(results[1].Body))
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, results[1].FallbackError, &timeoutErr)
+	require.Equal(t, "http://localhost:9990?fragment=FILTERED", timeoutErr.TemplateURL)
+
+	server.Close()
+}
+
 func TestCanIgnoreNon2xxErrors(t *testing.T) {
 	server := startServer(t)
 
@@ -180,6 +252,282 @@ func TestCanIgnoreNon2xxErrors(t *testing.T) {
 	server.Close()
 }
 
+func TestAcceptStatus(t *testing.T) {
+	server := startServer(t)
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/?fragment=oops"))
+	r.AcceptStatus = func(requestable Requestable, statusCode int) bool {
+		return requestable.URL() == "http://localhost:9990/?fragment=oops" && statusCode == 500
+	}
+
+	results, err := r.Do(context.Background())
+
+	require.Nil(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, 500, results[0].StatusCode)
+
+	r = newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/?fragment=oops"))
+	r.AcceptStatus = func(requestable Requestable, statusCode int) bool {
+		return statusCode == 404
+	}
+
+	_, err = r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+
+	server.Close()
+}
+
+func TestOptionalRequestableFallsBackOnError(t *testing.T) {
+	server := startServer(t)
+
+	optional := newFakeRequestable("http://localhost:9990/?fragment=oops")
+	optional.optional = true
+	optional.fallback = []byte("fallback")
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(optional)
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "<body>", string(results[0].Body))
+	require.False(t, results[0].Fallback)
+
+	require.True(t, results[1].Fallback)
+	require.Equal(t, "fallback", string(results[1].Body))
+	var resultErr *ResultError
+	require.ErrorAs(t, results[1].FallbackError, &resultErr)
+	require.Equal(t, 500, resultErr.Result.StatusCode)
+
+	server.Close()
+}
+
+func TestOptionalRequestableFallsBackOnTimeout(t *testing.T) {
+	server := startServer(t)
+	start := time.Now()
+
+	optional := newFakeRequestable("http://localhost:9990?fragment=slow")
+	optional.optional = true
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(optional)
+	r.Timeout = time.Duration(100) * time.Millisecond
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Duration(1)*time.Second)
+	require.Len(t, results, 2)
+	require.True(t, results[1].Fallback)
+	require.Empty(t, results[1].Body)
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, results[1].FallbackError, &timeoutErr)
+
+	server.Close()
+}
+
+func TestRequiredRequestableFailsWithOptionalSiblings(t *testing.T) {
+	server := startServer(t)
+
+	optional := newFakeRequestable("http://localhost:9990?fragment=header")
+	optional.optional = true
+
+	r := newRequest()
+	r.WithRequestable(optional)
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/?fragment=oops"))
+	results, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Len(t, results, 0)
+
+	server.Close()
+}
+
+func TestStreamYieldsResultsAsTheyComplete(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	optional := newFakeRequestable("http://localhost:9990?fragment=slow")
+	optional.optional = true
+	optional.fallback = []byte("fallback")
+
+	r := newRequest()
+	r.Timeout = 200 * time.Millisecond
+	r.WithRequestable(optional)
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+
+	var streamed []StreamResult
+	for result := range r.Stream(context.Background()) {
+		streamed = append(streamed, result)
+	}
+
+	require.Len(t, streamed, 2)
+	require.Equal(t, 1, streamed[0].Index)
+	require.Equal(t, "<body>", string(streamed[0].Result.Body))
+	require.NoError(t, streamed[0].Err)
+
+	require.Equal(t, 0, streamed[1].Index)
+	require.Equal(t, optional, streamed[1].Requestable)
+	require.True(t, streamed[1].Result.Fallback)
+	require.Equal(t, "fallback", string(streamed[1].Result.Body))
+}
+
+func TestDoEachStopsOnError(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=slow"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=oops"))
+
+	start := time.Now()
+	var indexes []int
+	err := r.DoEach(context.Background(), func(i int, requestable Requestable, result *Result, err error) {
+		indexes = append(indexes, i)
+		require.Nil(t, result)
+		require.Error(t, err)
+	})
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, []int{1}, indexes)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestDoEachTimeout(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.Timeout = 100 * time.Millisecond
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=slow"))
+
+	var errs []error
+	err := r.DoEach(context.Background(), func(i int, requestable Requestable, result *Result, err error) {
+		errs = append(errs, err)
+	})
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Len(t, errs, 2)
+	require.NoError(t, errs[0])
+	require.ErrorAs(t, errs[1], &timeoutErr)
+}
+
+func TestDoEachUsesResultsCompletedBeforeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+
+	optional := func(path string) *fakeRequestable {
+		requestable := newFakeRequestable(server.URL + path)
+		requestable.optional = true
+		requestable.fallback = []byte("fallback")
+		return requestable
+	}
+
+	// The deadline passes while the first result is handled, so the second
+	// result is waiting when the request times out.
+	for i := 0; i < 10; i++ {
+		r := newRequest()
+		r.Timeout = 20 * time.Millisecond
+		r.WithRequestable(optional("/header"))
+		r.WithRequestable(optional("/footer"))
+		r.WithRequestable(optional("/slow"))
+
+		bodies := make([]string, 3)
+		err := r.DoEach(context.Background(), func(i int, requestable Requestable, result *Result, err error) {
+			require.NoError(t, err)
+			if bodies[0] == "" && bodies[1] == "" {
+				time.Sleep(60 * time.Millisecond)
+			}
+			bodies[i] = string(result.Body)
+		})
+
+		require.NoError(t, err)
+		require.Equal(t, []string{"fresh", "fresh", "fallback"}, bodies)
+	}
+}
+
+func TestCollectReturnsEveryOutcome(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=slow"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=oops"))
+
+	var completed []int
+	outcomes, err := r.Collect(context.Background(), func(outcome *RequestableResult) {
+		completed = append(completed, outcome.Index)
+	})
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Len(t, outcomes, 2)
+	require.Equal(t, []int{1}, completed)
+
+	require.True(t, outcomes[0].Cancelled)
+	require.Nil(t, outcomes[0].Result)
+	require.ErrorIs(t, outcomes[0].Err, context.Canceled)
+
+	require.ErrorAs(t, outcomes[1].Err, &resultErr)
+	require.False(t, outcomes[1].Cancelled)
+
+	for i, outcome := range outcomes {
+		require.Equal(t, i, outcome.Index)
+		require.Greater(t, outcome.Duration, time.Duration(0))
+	}
+}
+
+func TestCollectKeepsOutcomesCompletedBeforeFailure(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oops" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		<-release
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable(server.URL + "/oops"))
+	r.WithRequestable(newFakeRequestable(server.URL + "/fresh"))
+
+	// The sibling completes while the failure is handled, so its result is
+	// waiting when DoEach returns the error.
+	outcomes, err := r.Collect(context.Background(), func(outcome *RequestableResult) {
+		if outcome.Err != nil {
+			close(release)
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.ErrorAs(t, outcomes[0].Err, &resultErr)
+
+	require.False(t, outcomes[1].Cancelled)
+	require.NoError(t, outcomes[1].Err)
+	require.Equal(t, "fresh", string(outcomes[1].Result.Body))
+}
+
 func startServer(t *testing.T) *http.Server {
 	var testServer *http.Server
 
@@ -234,6 +582,38 @@ func TestTimeoutError(t *testing.T) {
 
 	require.Equal(t, "multiplexer timed out: omg", err.Error())
 	require.Equal(t, originalError, err.Unwrap())
+
+	err = newRequestableTimeoutError("http://localhost/:name", originalError)
+	require.Equal(t, "multiplexer timed out fetching http://localhost/:name: omg", err.Error())
+	require.Equal(t, originalError, err.Unwrap())
+}
+
+func TestNewRequestWithoutSecretFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+
+		w.Write([]byte("header"))
+	}))
+	defer server.Close()
+
+	r := NewRequest(NewStandardTripper(&http.Client{}))
+	r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "header", string(results[0].Body))
+
+	slow := newFakeRequestable(server.URL + "/slow?token=secret")
+	slow.timeout = 10 * time.Millisecond
+	r = NewRequest(NewStandardTripper(&http.Client{}))
+	r.WithRequestable(slow)
+	_, err = r.Do(context.Background())
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.NotContains(t, timeoutErr.TemplateURL, "secret")
 }
 
 func newRequest() *Request {
@@ -1,6 +1,9 @@
 package multiplexer
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type RequestableContextKey struct{}
 
@@ -10,6 +13,82 @@ type Requestable interface {
 	Metadata() map[string]string
 }
 
+// FallbackRequestable is implemented by requestables that can be replaced with
+// fallback content when they fail, instead of failing the entire request.
+type FallbackRequestable interface {
+	Requestable
+	// Fallback returns the content used in place of a failed response and
+	// whether the requestable is optional.
+	Fallback() ([]byte, bool)
+}
+
+// TimeoutRequestable is implemented by requestables that have their own
+// timeout, which applies within the overall request Timeout.
+type TimeoutRequestable interface {
+	Requestable
+	// Timeout returns the maximum duration of the request, or zero when only
+	// the request's Timeout applies.
+	Timeout() time.Duration
+}
+
+// CacheableRequestable is implemented by requestables that can be served from
+// a Cache.
+type CacheableRequestable interface {
+	Requestable
+	// CacheTTL returns how long results are cached for, or zero to use the
+	// response's Cache-Control header.
+	CacheTTL() time.Duration
+	// CacheVary returns the request headers that results vary on, in addition
+	// to the response's Vary header.
+	CacheVary() []string
+}
+
+// StaleRequestable is implemented by cacheable requestables that can be served
+// from a Cache after they expire.
+type StaleRequestable interface {
+	Requestable
+	// StaleWhileRevalidate returns how long an expired result is served while
+	// it is refreshed in the background. Zero uses the response's
+	// Cache-Control header.
+	StaleWhileRevalidate() time.Duration
+	// StaleIfError returns how long an expired result is served when the
+	// target fails or times out. Zero uses the response's Cache-Control
+	// header.
+	StaleIfError() time.Duration
+}
+
+// KeyedRequestable is implemented by requestables that have a key identifying
+// them within the page, which is added to their spans.
+type KeyedRequestable interface {
+	Requestable
+	Key() string
+}
+
+// BackendRequestable is implemented by requestables that can be fetched from a
+// Backend other than the request's default target.
+type BackendRequestable interface {
+	Requestable
+	// Backend returns the backend the requestable is fetched from, or nil to
+	// use the request's Signer or HmacSecret and Tripper.
+	Backend() *Backend
+}
+
+// RetryableRequestable is implemented by requestables that have their own
+// RetryPolicy.
+type RetryableRequestable interface {
+	Requestable
+	// RetryPolicy returns the policy used to retry the requestable, or nil to
+	// use the request's RetryPolicy.
+	RetryPolicy() *RetryPolicy
+}
+
+// PrioritizedRequestable is implemented by requestables that are sent ahead of
+// lower priority requestables when they are queued by a Limiter.
+type PrioritizedRequestable interface {
+	Requestable
+	Priority() int
+}
+
 func RequestableFromContext(ctx context.Context) Requestable {
 	if ctx == nil {
 		return nil
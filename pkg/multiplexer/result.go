@@ -34,12 +34,65 @@ type Result struct {
 	HttpResponse *http.Response
 	Body         []byte
 	StatusCode   int
+	// Fallback is true when the requestable failed and Body contains its
+	// fallback content instead of a response from the target.
+	Fallback bool
+	// FallbackError is the error that caused the fallback to be used.
+	FallbackError error
+	// CacheHit is true when the result was served from the request's Cache.
+	CacheHit bool
+	// Stale is true when the cached result has expired, and was served while
+	// being revalidated or because the target failed.
+	Stale bool
+}
+
+// RequestableResult is the outcome of a single requestable, including
+// requestables that failed or were cancelled.
+type RequestableResult struct {
+	// Index matches the order requestables were added in
+	Index       int
+	Requestable Requestable
+	// Key is set when the requestable is a KeyedRequestable
+	Key    string
+	Result *Result
+	Err    error
+	// Duration is the time from the start of the request until the
+	// requestable completed, failed, or was cancelled.
+	Duration time.Duration
+	// Cancelled is true when the requestable did not complete because another
+	// requestable failed.
+	Cancelled bool
 }
 
 func (r *Result) Header() http.Header {
+	if r.HttpResponse == nil {
+		return http.Header{}
+	}
+
 	return r.HttpResponse.Header
 }
 
+// fallbackResult returns a result containing the fallback content of the given
+// requestable, or nil if the requestable does not provide a fallback.
+func fallbackResult(requestable Requestable, err error) *Result {
+	fallbackable, ok := requestable.(FallbackRequestable)
+	if !ok {
+		return nil
+	}
+
+	body, ok := fallbackable.Fallback()
+	if !ok {
+		return nil
+	}
+
+	return &Result{
+		Url:           requestable.URL(),
+		Body:          body,
+		Fallback:      true,
+		FallbackError: err,
+	}
+}
+
 func (r *Result) HeadersWithoutProxyHeaders() http.Header {
 	headers := make(http.Header)
 
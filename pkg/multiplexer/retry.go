@@ -0,0 +1,148 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+)
+
+// defaultRetryStatuses are retried when a RetryPolicy has no RetryStatuses.
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// RetryPolicy configures retrying fragment requests that fail with a
+// connection error or a retryable status. Only GET requests are retried.
+//
+// Retries wait for an exponential backoff with jitter, or the duration of the
+// response's `Retry-After` header when it is longer, and are only made when
+// they can complete before the request's deadline.
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first. Values less than 2
+	// disable retries.
+	MaxAttempts int
+	// The backoff before the first retry, which doubles for each subsequent
+	// retry. Defaults to 50ms.
+	InitialBackoff time.Duration
+	// The maximum backoff between attempts. Responses with a longer
+	// `Retry-After` are not retried. Defaults to 1s.
+	MaxBackoff time.Duration
+	// The response statuses that are retried. Defaults to 502, 503 and 504.
+	RetryStatuses []int
+}
+
+// backoff returns how long to wait before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+
+	backoff := initial << (retry - 1)
+	if max := p.maxBackoff(); backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	// Use half of the backoff plus a random jitter of up to the other half, so
+	// that concurrent requests don't retry in lockstep.
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (p *RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return defaultRetryMaxBackoff
+	}
+
+	return p.MaxBackoff
+}
+
+func (p *RetryPolicy) retriesStatus(statusCode int) bool {
+	statuses := p.RetryStatuses
+	if statuses == nil {
+		statuses = defaultRetryStatuses
+	}
+
+	for _, status := range statuses {
+		if status == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDelay returns how long to wait before retrying the failed attempt, and
+// false when the attempt should not be retried.
+func (p *RetryPolicy) retryDelay(ctx context.Context, retry int, result *Result, err error) (time.Duration, bool) {
+	if ctx.Err() != nil {
+		return 0, false
+	}
+
+	// Requests shed by the Limiter are not retried, since retrying would add
+	// to the load that caused them to be shed.
+	var limitErr *LimitExceededError
+	if errors.As(err, &limitErr) {
+		return 0, false
+	}
+
+	var resultErr *ResultError
+	if errors.As(err, &resultErr) {
+		result = resultErr.Result
+	} else if err != nil {
+		result = nil
+	}
+
+	if result != nil && !p.retriesStatus(result.StatusCode) {
+		return 0, false
+	}
+
+	delay := p.backoff(retry)
+	if result != nil {
+		if retryAfter, ok := parseRetryAfter(result.Header().Get("Retry-After"), time.Now()); ok && retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+
+	if delay > p.maxBackoff() {
+		return 0, false
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// parseRetryAfter parses a `Retry-After` header containing either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+
+		return 0, true
+	}
+
+	return 0, false
+}
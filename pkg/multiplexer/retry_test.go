@@ -0,0 +1,167 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetriesConnectionErrors(t *testing.T) {
+	var attempts int32
+	var authorizations []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("X-Authorization-Time"))
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+
+		w.Write([]byte("header"))
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.HmacSecret = "abc123"
+	r.RetryPolicy = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "header", string(results[0].Body))
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	require.Len(t, authorizations, 2)
+	require.NotEmpty(t, authorizations[1])
+}
+
+func TestRetriesStatuses(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("header"))
+		}
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.RetryPolicy = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "header", string(results[0].Body))
+	require.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestRetriesStopAtMaxAttempts(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.RetryPolicy = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	// 500 isn't retried by default
+	r.WithRequestable(newFakeRequestable(server.URL + "/default"))
+
+	_, err := r.Do(context.Background())
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, 500, resultErr.Result.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+
+	overridden := newFakeRequestable(server.URL + "/overridden")
+	overridden.retryPolicy = &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, RetryStatuses: []int{500}}
+	overridden.optional = true
+
+	r = newRequest()
+	r.WithRequestable(overridden)
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.True(t, results[0].Fallback)
+	require.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestRetriesRespectDeadline(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	r := newRequest()
+	r.Timeout = 500 * time.Millisecond
+	r.RetryPolicy = &RetryPolicy{MaxAttempts: 3, MaxBackoff: 5 * time.Second}
+	r.WithRequestable(newFakeRequestable(server.URL + "/header"))
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, http.StatusServiceUnavailable, resultErr.Result.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(1)
+		require.GreaterOrEqual(t, backoff, 50*time.Millisecond)
+		require.LessOrEqual(t, backoff, 100*time.Millisecond)
+
+		backoff = policy.backoff(2)
+		require.GreaterOrEqual(t, backoff, 100*time.Millisecond)
+		require.LessOrEqual(t, backoff, 200*time.Millisecond)
+
+		backoff = policy.backoff(10)
+		require.GreaterOrEqual(t, backoff, 150*time.Millisecond)
+		require.LessOrEqual(t, backoff, 300*time.Millisecond)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	delay, ok := parseRetryAfter("3", now)
+	require.True(t, ok)
+	require.Equal(t, 3*time.Second, delay)
+
+	delay, ok = parseRetryAfter("Fri, 01 Jan 2021 00:00:10 GMT", now)
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, delay)
+
+	delay, ok = parseRetryAfter("Thu, 31 Dec 2020 00:00:00 GMT", now)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), delay)
+
+	_, ok = parseRetryAfter("", now)
+	require.False(t, ok)
+
+	_, ok = parseRetryAfter("soon", now)
+	require.False(t, ok)
+}
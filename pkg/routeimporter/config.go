@@ -1,6 +1,9 @@
 package routeimporter
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/blakewilliams/viewproxy"
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
 )
@@ -9,7 +12,11 @@ type ConfigFragment struct {
 	Path             string
 	Metadata         map[string]string
 	IgnoreValidation bool
-	Children         map[string]ConfigFragment
+	// Timeout is parsed with time.ParseDuration, e.g. "250ms"
+	Timeout  string
+	Children map[string]ConfigFragment
+	// Backend is the name of a backend added via Server.AddBackend
+	Backend string
 }
 
 type ConfigRouteEntry struct {
@@ -21,9 +28,12 @@ type ConfigRouteEntry struct {
 
 func LoadRoutes(server *viewproxy.Server, routeEntries []ConfigRouteEntry) error {
 	for _, routeEntry := range routeEntries {
-		root := createFragment(routeEntry.Root)
+		root, err := createFragment(routeEntry.Root)
+		if err != nil {
+			return err
+		}
 
-		err := server.Get(
+		err = server.Get(
 			routeEntry.Path,
 			root,
 			viewproxy.WithRouteMetadata(routeEntry.Metadata),
@@ -37,13 +47,29 @@ func LoadRoutes(server *viewproxy.Server, routeEntries []ConfigRouteEntry) error
 	return nil
 }
 
-func createFragment(template ConfigFragment) *fragment.Definition {
+func createFragment(template ConfigFragment) (*fragment.Definition, error) {
 	f := fragment.Define(template.Path, fragment.WithMetadata(template.Metadata))
 	f.IgnoreValidation = template.IgnoreValidation
 
+	if template.Backend != "" {
+		fragment.WithBackend(template.Backend)(f)
+	}
+
+	if template.Timeout != "" {
+		timeout, err := time.ParseDuration(template.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for fragment %s: %w", template.Path, err)
+		}
+		fragment.WithTimeout(timeout)(f)
+	}
+
 	for name, child := range template.Children {
-		fragment.WithChild(name, createFragment(child))(f)
+		childFragment, err := createFragment(child)
+		if err != nil {
+			return nil, err
+		}
+		fragment.WithChild(name, childFragment)(f)
 	}
 
-	return f
+	return f, nil
 }
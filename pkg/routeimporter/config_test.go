@@ -2,8 +2,10 @@ package routeimporter
 
 import (
 	"testing"
+	"time"
 
 	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,3 +21,69 @@ func TestLoadRoutesError(t *testing.T) {
 	err = LoadRoutes(server, []ConfigRouteEntry{entry})
 	require.Error(t, err)
 }
+
+func TestLoadRoutesTimeout(t *testing.T) {
+	server, err := viewproxy.NewServer("localhost:9999")
+	require.NoError(t, err)
+
+	entry := ConfigRouteEntry{
+		Path: "/foo/:name",
+		Root: ConfigFragment{
+			Path: "/layout/:name",
+			Children: map[string]ConfigFragment{
+				"sidebar": {Path: "/sidebar/:name", Timeout: "250ms"},
+			},
+		},
+	}
+
+	err = LoadRoutes(server, []ConfigRouteEntry{entry})
+	require.NoError(t, err)
+
+	root := server.Routes()[0].RootFragment
+	require.Equal(t, time.Duration(0), root.Timeout)
+	require.Equal(t, 250*time.Millisecond, root.Child("sidebar").Timeout)
+}
+
+func TestLoadRoutesInvalidTimeout(t *testing.T) {
+	server, err := viewproxy.NewServer("localhost:9999")
+	require.NoError(t, err)
+
+	entry := ConfigRouteEntry{
+		Path: "/foo/:name",
+		Root: ConfigFragment{Path: "/layout/:name", Timeout: "soon"},
+	}
+
+	err = LoadRoutes(server, []ConfigRouteEntry{entry})
+	require.ErrorContains(t, err, "invalid timeout for fragment /layout/:name")
+}
+
+func TestLoadRoutesBackend(t *testing.T) {
+	server, err := viewproxy.NewServer("localhost:9999")
+	require.NoError(t, err)
+
+	backend, err := multiplexer.NewBackend("http://search.example.com")
+	require.NoError(t, err)
+	server.AddBackend("search", backend)
+
+	entry := ConfigRouteEntry{
+		Path: "/foo/:name",
+		Root: ConfigFragment{
+			Path: "/layout/:name",
+			Children: map[string]ConfigFragment{
+				"results": {Path: "/results/:name", Backend: "search"},
+			},
+		},
+	}
+
+	err = LoadRoutes(server, []ConfigRouteEntry{entry})
+	require.NoError(t, err)
+
+	root := server.Routes()[0].RootFragment
+	require.Equal(t, "", root.Backend)
+	require.Equal(t, "search", root.Child("results").Backend)
+
+	entry.Root.Children["results"] = ConfigFragment{Path: "/results/:name", Backend: "missing"}
+
+	err = LoadRoutes(server, []ConfigRouteEntry{entry})
+	require.EqualError(t, err, "route /foo/:name has fragment /results/:name with unknown backend missing")
+}
@@ -2,17 +2,14 @@ package routeimporter
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/signing"
 )
 
 func LoadHttp(ctx context.Context, server *viewproxy.Server, path string) error {
@@ -31,8 +28,10 @@ func LoadHttp(ctx context.Context, server *viewproxy.Server, path string) error
 		return fmt.Errorf("Could not create a request when loading config: %w", err)
 	}
 
-	if server.HmacSecret != "" {
-		setHmacHeaders(req, server.HmacSecret)
+	if signer := signerFor(server); signer != nil {
+		if err := signer.Sign(req); err != nil {
+			return fmt.Errorf("could not sign route config request: %w", err)
+		}
 	}
 
 	resp, err := http.DefaultClient.Do(req)
@@ -58,14 +57,15 @@ func LoadHttp(ctx context.Context, server *viewproxy.Server, path string) error
 	return ctx.Err()
 }
 
-func setHmacHeaders(r *http.Request, hmacSecret string) {
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+func signerFor(server *viewproxy.Server) *signing.Signer {
+	if server.Signer != nil {
+		return server.Signer
+	}
 
-	mac := hmac.New(sha256.New, []byte(hmacSecret))
-	mac.Write(
-		[]byte(fmt.Sprintf("%s,%s", r.URL.Path, timestamp)),
-	)
+	// Route config requests have always been signed without the query.
+	if server.HmacSecret != "" {
+		return signing.NewPathSigner(server.HmacSecret)
+	}
 
-	r.Header.Set("Authorization", hex.EncodeToString(mac.Sum(nil)))
-	r.Header.Set("X-Authorization-Time", timestamp)
+	return nil
 }
@@ -106,6 +106,37 @@ func TestLoadHttp_HMAC(t *testing.T) {
 	requireJsonConfigRoutesLoaded(t, viewproxyServer.Routes())
 }
 
+func TestLoadHttp_HMACSignsPathWithoutQuery(t *testing.T) {
+	hmacSecret := "abc123"
+
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "env=test", r.URL.RawQuery)
+
+		mac := hmac.New(sha256.New, []byte(hmacSecret))
+		mac.Write(
+			[]byte(fmt.Sprintf("%s,%s", r.URL.Path, r.Header.Get("X-Authorization-Time"))),
+		)
+
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("Authorization"))
+
+		w.Write(jsonConfig)
+	})
+
+	testServer := httptest.NewServer(instance)
+	defer testServer.CloseClientConnections()
+	defer testServer.Close()
+
+	viewproxyServer, err := viewproxy.NewServer(testServer.URL + "?env=test")
+	require.NoError(t, err)
+	viewproxyServer.HmacSecret = hmacSecret
+	viewproxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	err = LoadHttp(context.TODO(), viewproxyServer, "/_viewproxy_routes")
+	require.NoError(t, err)
+
+	requireJsonConfigRoutesLoaded(t, viewproxyServer.Routes())
+}
+
 func startTargetServer() *httptest.Server {
 	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Query().Get("sleepy") == "1" {
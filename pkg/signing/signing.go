@@ -0,0 +1,368 @@
+// Package signing signs requests made by viewproxy with an HMAC, so that
+// target servers can verify that requests came from viewproxy.
+//
+// Two schemes are supported. The legacy scheme, used by NewSigner, signs
+// `path?query,timestamp` with a single secret. The v2 scheme, used by
+// NewV2Signer, signs a configurable canonical string that can include the
+// method, host and selected headers, and supports multiple keys identified by
+// a key ID so that secrets can be rotated without a coordinated deploy.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderSignature contains the hex encoded HMAC of the request.
+	HeaderSignature = "Authorization"
+	// HeaderTimestamp contains the unix timestamp the request was signed at.
+	HeaderTimestamp = "X-Authorization-Time"
+	// HeaderVersion contains the version of the signing scheme. It is only
+	// sent by the v2 scheme.
+	HeaderVersion = "X-Authorization-Version"
+	// HeaderKeyID contains the ID of the key used to sign the request.
+	HeaderKeyID = "X-Authorization-Key-Id"
+	// HeaderComponents lists the components of the canonical string, in
+	// order, separated by spaces.
+	HeaderComponents = "X-Authorization-Components"
+	// HeaderMaxAge contains the number of seconds after the timestamp that
+	// the target should accept the request for, to limit replayed requests.
+	HeaderMaxAge = "X-Authorization-Max-Age"
+)
+
+type Version int
+
+const (
+	// Legacy signs `path?query,timestamp` with a single secret.
+	Legacy Version = 1
+	// V2 signs a canonical string built from the signer's Components.
+	V2 Version = 2
+)
+
+// Component is part of the request included in the v2 canonical string.
+// Components starting with `@` are derived from the request, and all other
+// components are request headers.
+type Component string
+
+const (
+	ComponentMethod Component = "@method"
+	// ComponentHost is the host the request is sent to. Trippers that change
+	// the host after signing, such as a load balancer, invalidate it.
+	ComponentHost Component = "@host"
+	// ComponentPath is the path and query of the request.
+	ComponentPath      Component = "@path"
+	ComponentTimestamp Component = "@timestamp"
+	ComponentKeyID     Component = "@key-id"
+)
+
+// HeaderComponent returns a component for the given request header, e.g. a
+// forwarded identity header like `X-Forwarded-For`.
+func HeaderComponent(name string) Component {
+	return Component(strings.ToLower(name))
+}
+
+// DefaultComponents are signed by NewV2Signer when no components are given.
+var DefaultComponents = []Component{ComponentMethod, ComponentPath, ComponentTimestamp}
+
+// Key is a secret used to sign requests, identified by its ID.
+type Key struct {
+	ID     string
+	Secret string
+}
+
+var (
+	ErrMissingSignature = errors.New("signing: request is not signed")
+	ErrInvalidSignature = errors.New("signing: invalid signature")
+	ErrExpired          = errors.New("signing: signature has expired")
+	ErrUnknownKey       = errors.New("signing: unknown key id")
+	// ErrMissingComponents is returned when a request's signature does not
+	// cover every component the verifier is configured to sign.
+	ErrMissingComponents = errors.New("signing: signature does not cover the required components")
+)
+
+// Signer signs requests with the first of its keys, and verifies requests
+// signed with any of its keys.
+type Signer struct {
+	Version Version
+	// The components signed by the v2 scheme. ComponentTimestamp and
+	// ComponentKeyID are always signed.
+	Components []Component
+	// When set, the HeaderMaxAge hint is sent, and Verify rejects requests
+	// signed more than ReplayWindow before or after the current time.
+	ReplayWindow time.Duration
+	mu           sync.RWMutex
+	keys         []Key
+	// when true, the legacy scheme signs the path without the query
+	pathOnly bool
+	now      func() time.Time
+}
+
+// NewSigner returns a Signer using the legacy scheme.
+func NewSigner(secret string) *Signer {
+	return &Signer{
+		Version: Legacy,
+		keys:    []Key{{Secret: secret}},
+		now:     time.Now,
+	}
+}
+
+// NewPathSigner returns a Signer using the legacy scheme, but signing only the
+// path of the request without its query, as route config requests made by
+// routeimporter have always been signed.
+func NewPathSigner(secret string) *Signer {
+	signer := NewSigner(secret)
+	signer.pathOnly = true
+
+	return signer
+}
+
+// NewV2Signer returns a Signer using the v2 scheme, signing with the first key
+// and signing the given components, or DefaultComponents when none are given.
+func NewV2Signer(keys []Key, components ...Component) *Signer {
+	if len(components) == 0 {
+		components = DefaultComponents
+	}
+
+	return &Signer{
+		Version:    V2,
+		Components: components,
+		keys:       keys,
+		now:        time.Now,
+	}
+}
+
+// SetKeys replaces the signer's keys. Requests are signed with the first key,
+// so rotating a secret is done by adding the new key to the targets that
+// verify requests, then making it the first key here, and finally removing the
+// old key.
+func (s *Signer) SetKeys(keys ...Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = keys
+}
+
+func (s *Signer) Keys() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]Key, len(s.keys))
+	copy(keys, s.keys)
+
+	return keys
+}
+
+// Sign sets the signature headers on the given request.
+func (s *Signer) Sign(r *http.Request) error {
+	keys := s.Keys()
+	if len(keys) == 0 {
+		return errors.New("signing: no keys to sign with")
+	}
+
+	key := keys[0]
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+
+	if s.Version != V2 {
+		r.Header.Set(HeaderSignature, sign(key.Secret, s.legacyCanonicalString(r, timestamp)))
+		r.Header.Set(HeaderTimestamp, timestamp)
+		return nil
+	}
+
+	components := s.components()
+
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderVersion, strconv.Itoa(int(V2)))
+	r.Header.Set(HeaderKeyID, key.ID)
+	r.Header.Set(HeaderComponents, joinComponents(components))
+	if s.ReplayWindow > 0 {
+		r.Header.Set(HeaderMaxAge, strconv.Itoa(int(s.ReplayWindow/time.Second)))
+	}
+
+	r.Header.Set(HeaderSignature, sign(key.Secret, CanonicalString(r, components)))
+	return nil
+}
+
+// Verify returns an error unless the request has a valid signature from one of
+// the signer's keys, using the scheme and components sent with the request.
+// Signers using the v2 scheme only accept v2 signatures that cover each of
+// their components.
+func (s *Signer) Verify(r *http.Request) error {
+	signature := r.Header.Get(HeaderSignature)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	if signature == "" || timestamp == "" {
+		return ErrMissingSignature
+	}
+
+	if s.ReplayWindow > 0 {
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("signing: invalid timestamp %q: %w", timestamp, err)
+		}
+
+		age := s.now().Sub(time.Unix(signedAt, 0))
+		if age > s.ReplayWindow || age < -s.ReplayWindow {
+			return ErrExpired
+		}
+	}
+
+	if r.Header.Get(HeaderVersion) != strconv.Itoa(int(V2)) {
+		if s.Version == V2 {
+			return ErrMissingComponents
+		}
+
+		canonical := s.legacyCanonicalString(r, timestamp)
+
+		for _, key := range s.Keys() {
+			if hmac.Equal([]byte(signature), []byte(sign(key.Secret, canonical))) {
+				return nil
+			}
+		}
+
+		return ErrInvalidSignature
+	}
+
+	keyID := r.Header.Get(HeaderKeyID)
+	components := splitComponents(r.Header.Get(HeaderComponents))
+	if !covers(components, s.components()) {
+		return ErrMissingComponents
+	}
+
+	for _, key := range s.Keys() {
+		if key.ID != keyID {
+			continue
+		}
+
+		if hmac.Equal([]byte(signature), []byte(sign(key.Secret, CanonicalString(r, components)))) {
+			return nil
+		}
+
+		return ErrInvalidSignature
+	}
+
+	return ErrUnknownKey
+}
+
+// components returns the configured components along with the components
+// that are always signed.
+func (s *Signer) components() []Component {
+	components := make([]Component, 0, len(s.Components)+2)
+	hasTimestamp, hasKeyID := false, false
+
+	for _, component := range s.Components {
+		components = append(components, component)
+		hasTimestamp = hasTimestamp || component == ComponentTimestamp
+		hasKeyID = hasKeyID || component == ComponentKeyID
+	}
+
+	if !hasTimestamp {
+		components = append(components, ComponentTimestamp)
+	}
+
+	if !hasKeyID {
+		components = append(components, ComponentKeyID)
+	}
+
+	return components
+}
+
+// CanonicalString returns the v2 string that is signed for the given request
+// and components, with a `name: value` line for each component.
+func CanonicalString(r *http.Request, components []Component) string {
+	var canonical strings.Builder
+
+	for i, component := range components {
+		if i > 0 {
+			canonical.WriteByte('\n')
+		}
+
+		canonical.WriteString(string(component))
+		canonical.WriteString(": ")
+		canonical.WriteString(componentValue(r, component))
+	}
+
+	return canonical.String()
+}
+
+func componentValue(r *http.Request, component Component) string {
+	switch component {
+	case ComponentMethod:
+		return r.Method
+	case ComponentHost:
+		if r.Host != "" {
+			return r.Host
+		}
+		return r.URL.Host
+	case ComponentPath:
+		return r.URL.RequestURI()
+	case ComponentTimestamp:
+		return r.Header.Get(HeaderTimestamp)
+	case ComponentKeyID:
+		return r.Header.Get(HeaderKeyID)
+	}
+
+	return strings.Join(r.Header.Values(string(component)), ", ")
+}
+
+// legacyCanonicalString returns the string signed by the legacy scheme, the
+// unescaped path and the query of the request followed by the timestamp.
+func (s *Signer) legacyCanonicalString(r *http.Request, timestamp string) string {
+	if r.URL.RawQuery != "" && !s.pathOnly {
+		return fmt.Sprintf("%s?%s,%s", r.URL.Path, r.URL.RawQuery, timestamp)
+	}
+
+	return fmt.Sprintf("%s,%s", r.URL.Path, timestamp)
+}
+
+func sign(secret string, canonical string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func joinComponents(components []Component) string {
+	names := make([]string, len(components))
+	for i, component := range components {
+		names[i] = string(component)
+	}
+
+	return strings.Join(names, " ")
+}
+
+func splitComponents(header string) []Component {
+	names := strings.Fields(header)
+	components := make([]Component, len(names))
+	for i, name := range names {
+		components[i] = Component(name)
+	}
+
+	return components
+}
+
+// covers returns true when every required component is in components.
+func covers(components []Component, required []Component) bool {
+	for _, requiredComponent := range required {
+		found := false
+		for _, component := range components {
+			if component == requiredComponent {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
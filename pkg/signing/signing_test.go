@@ -0,0 +1,156 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignerLegacy(t *testing.T) {
+	signer := NewSigner("abc123")
+
+	r := httptest.NewRequest("GET", "http://localhost/foo/bar?baz=1", nil)
+	require.NoError(t, signer.Sign(r))
+
+	timestamp := r.Header.Get(HeaderTimestamp)
+	require.NotEmpty(t, timestamp)
+
+	mac := hmac.New(sha256.New, []byte("abc123"))
+	mac.Write([]byte(fmt.Sprintf("/foo/bar?baz=1,%s", timestamp)))
+
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get(HeaderSignature))
+	require.Empty(t, r.Header.Get(HeaderVersion))
+	require.Empty(t, r.Header.Get(HeaderKeyID))
+	require.NoError(t, signer.Verify(r))
+}
+
+func TestPathSigner(t *testing.T) {
+	signer := NewPathSigner("abc123")
+
+	r := httptest.NewRequest("GET", "http://localhost/foo/bar?baz=1", nil)
+	require.NoError(t, signer.Sign(r))
+
+	mac := hmac.New(sha256.New, []byte("abc123"))
+	mac.Write([]byte(fmt.Sprintf("/foo/bar,%s", r.Header.Get(HeaderTimestamp))))
+
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get(HeaderSignature))
+	require.NoError(t, signer.Verify(r))
+	require.ErrorIs(t, NewSigner("abc123").Verify(r), ErrInvalidSignature)
+}
+
+func TestSignerV2(t *testing.T) {
+	signer := NewV2Signer(
+		[]Key{{ID: "2024", Secret: "new"}, {ID: "2023", Secret: "old"}},
+		ComponentMethod, ComponentHost, ComponentPath, HeaderComponent("X-Forwarded-For"),
+	)
+	signer.ReplayWindow = 30 * time.Second
+
+	r := httptest.NewRequest("GET", "http://localhost/foo?bar=1", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	require.NoError(t, signer.Sign(r))
+
+	require.Equal(t, "2", r.Header.Get(HeaderVersion))
+	require.Equal(t, "2024", r.Header.Get(HeaderKeyID))
+	require.Equal(t, "@method @host @path x-forwarded-for @timestamp @key-id", r.Header.Get(HeaderComponents))
+	require.Equal(t, "30", r.Header.Get(HeaderMaxAge))
+
+	canonical := fmt.Sprintf(
+		"@method: GET\n@host: localhost\n@path: /foo?bar=1\nx-forwarded-for: 10.0.0.1\n@timestamp: %s\n@key-id: 2024",
+		r.Header.Get(HeaderTimestamp),
+	)
+	mac := hmac.New(sha256.New, []byte("new"))
+	mac.Write([]byte(canonical))
+
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get(HeaderSignature))
+	require.NoError(t, signer.Verify(r))
+
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	require.ErrorIs(t, signer.Verify(r), ErrInvalidSignature)
+
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Method = "POST"
+	require.ErrorIs(t, signer.Verify(r), ErrInvalidSignature)
+}
+
+func TestSignerV2RequiresConfiguredComponents(t *testing.T) {
+	keys := []Key{{ID: "1", Secret: "secret"}}
+	verifier := NewV2Signer(keys, ComponentMethod, ComponentPath, HeaderComponent("X-Forwarded-For"))
+
+	// Signed by a caller that leaves out a component the verifier requires
+	r := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	require.NoError(t, NewV2Signer(keys, ComponentPath).Sign(r))
+	require.ErrorIs(t, verifier.Verify(r), ErrMissingComponents)
+
+	// Legacy signatures cover neither the method nor headers
+	r = httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.NoError(t, NewSigner("secret").Sign(r))
+	require.ErrorIs(t, verifier.Verify(r), ErrMissingComponents)
+
+	// Covering more components than required is allowed
+	r = httptest.NewRequest("GET", "http://localhost/foo", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	require.NoError(t, NewV2Signer(keys, ComponentMethod, ComponentHost, ComponentPath, HeaderComponent("X-Forwarded-For")).Sign(r))
+	require.NoError(t, verifier.Verify(r))
+}
+
+func TestSignerRotatesKeys(t *testing.T) {
+	signer := NewV2Signer([]Key{{ID: "old", Secret: "old-secret"}})
+	verifier := NewV2Signer([]Key{{ID: "old", Secret: "old-secret"}})
+
+	r := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.NoError(t, signer.Sign(r))
+	require.NoError(t, verifier.Verify(r))
+
+	// Targets accept the new key before viewproxy signs with it
+	verifier.SetKeys(Key{ID: "old", Secret: "old-secret"}, Key{ID: "new", Secret: "new-secret"})
+	require.NoError(t, verifier.Verify(r))
+
+	signer.SetKeys(Key{ID: "new", Secret: "new-secret"}, Key{ID: "old", Secret: "old-secret"})
+	r = httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.NoError(t, signer.Sign(r))
+	require.Equal(t, "new", r.Header.Get(HeaderKeyID))
+	require.NoError(t, verifier.Verify(r))
+
+	verifier.SetKeys(Key{ID: "old", Secret: "old-secret"})
+	require.ErrorIs(t, verifier.Verify(r), ErrUnknownKey)
+}
+
+func TestSignerLegacyVerifiesAnyKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.NoError(t, NewSigner("old").Sign(r))
+
+	verifier := NewSigner("new")
+	require.ErrorIs(t, verifier.Verify(r), ErrInvalidSignature)
+
+	verifier.SetKeys(Key{Secret: "new"}, Key{Secret: "old"})
+	require.NoError(t, verifier.Verify(r))
+}
+
+func TestSignerReplayWindow(t *testing.T) {
+	now := time.Now()
+	signer := NewV2Signer([]Key{{ID: "1", Secret: "secret"}})
+	signer.ReplayWindow = time.Minute
+	signer.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.NoError(t, signer.Sign(r))
+	require.NoError(t, signer.Verify(r))
+
+	now = now.Add(2 * time.Minute)
+	require.ErrorIs(t, signer.Verify(r), ErrExpired)
+
+	r = httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.ErrorIs(t, signer.Verify(r), ErrMissingSignature)
+}
+
+func TestSignerWithoutKeys(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	require.Error(t, NewV2Signer(nil).Sign(r))
+}
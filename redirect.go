@@ -0,0 +1,126 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// isRedirectStatus returns true for statuses that redirect the client to the
+// response's Location. Other 3xx statuses, like 304 Not Modified, are not
+// redirects.
+func isRedirectStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+func isRedirect(result *multiplexer.Result) bool {
+	return isRedirectStatus(result.StatusCode) && result.Header().Get("Location") != ""
+}
+
+// redirectKeys returns the keys of the fragments that can redirect the client,
+// in fragment order.
+func (r *Route) redirectKeys() []string {
+	keys := make([]string, 0)
+	fragments := r.FragmentsToRequest()
+
+	for i, key := range r.FragmentOrder() {
+		if key == "root" || fragments[i].Redirects {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// redirectFor returns the first redirect returned by a fragment that can
+// redirect the client, if any, along with the fragment that returned it.
+func (r *Route) redirectFor(results map[string]*multiplexer.Result) (*multiplexer.Result, *fragment.Definition) {
+	fragments := r.FragmentsToRequest()
+
+	for _, key := range r.redirectKeys() {
+		result, ok := results[key]
+		if ok && !result.Fallback && isRedirect(result) {
+			for i, fragmentKey := range r.FragmentOrder() {
+				if fragmentKey == key {
+					return result, fragments[i]
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// withRedirects sends redirects from fragments to the client instead of
+// stitching the page.
+func withRedirects(s *Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		route := RouteFromContext(r.Context())
+		results := multiplexer.ResultsFromContext(r.Context())
+
+		if route == nil || results == nil || results.Error() != nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		var resultMap map[string]*multiplexer.Result
+		if stream := resultStreamFromContext(r.Context()); stream != nil {
+			resultMap = stream.completed()
+		} else {
+			resultMap = mapResultsToFragmentKey(route, results.Results())
+		}
+
+		redirect, definition := route.redirectFor(resultMap)
+		if redirect == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		rw.Header().Set("Location", s.publicLocation(r, redirect.Header().Get("Location"), definition))
+
+		for _, cookie := range redirect.Header().Values("Set-Cookie") {
+			rw.Header().Add("Set-Cookie", cookie)
+		}
+
+		rw.WriteHeader(redirect.StatusCode)
+	})
+}
+
+// publicLocation rewrites Location headers pointing at the target server, or
+// at the backend of the fragment that redirected, to point at the host the
+// client requested.
+func (s *Server) publicLocation(r *http.Request, location string, definition *fragment.Definition) string {
+	locationURL, err := url.Parse(location)
+	if err != nil || locationURL.Host == "" {
+		return location
+	}
+
+	internalHost := locationURL.Host == s.targetURL.Host
+	if backend, ok := s.backends[definition.Backend]; ok {
+		internalHost = internalHost || locationURL.Host == backend.URL.Host
+	}
+
+	if !internalHost {
+		return location
+	}
+
+	locationURL.Host = r.Host
+	locationURL.Scheme = "http"
+
+	if r.TLS != nil {
+		locationURL.Scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		locationURL.Scheme = proto
+	}
+
+	return locationURL.String()
+}
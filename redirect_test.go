@@ -0,0 +1,158 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+func startRedirectTargetServer() *httptest.Server {
+	var target *httptest.Server
+
+	target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Add("Set-Cookie", "layout=1")
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/redirect":
+			w.Header().Add("Set-Cookie", "session=expired")
+			http.Redirect(w, r, target.URL+"/login?return_to=%2Fhello", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, "https://login.example.com/", http.StatusSeeOther)
+		case "/not-modified":
+			w.Header().Set("Location", target.URL+"/login")
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Write([]byte("body"))
+		}
+	}))
+
+	return target
+}
+
+func TestRootFragmentRedirects(t *testing.T) {
+	target := startRedirectTargetServer()
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	err := server.Get("/hello", fragment.Define("/redirect", fragment.WithChild("body", fragment.Define("/body"))))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "https://viewproxy.example.com/hello", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "https://viewproxy.example.com/login?return_to=%2Fhello", resp.Header.Get("Location"))
+	require.Equal(t, []string{"session=expired"}, resp.Header.Values("Set-Cookie"))
+	require.Empty(t, w.Body.String())
+}
+
+func TestFragmentRedirects(t *testing.T) {
+	target := startRedirectTargetServer()
+	defer target.Close()
+
+	for _, streaming := range []bool{false, true} {
+		server := newServer(t, target.URL)
+		server.Streaming = streaming
+
+		err := server.Get("/hello", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/external", fragment.WithRedirects()))))
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("GET", "/hello", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+
+		server.CreateHandler().ServeHTTP(w, r)
+
+		resp := w.Result()
+		require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		require.Equal(t, "https://login.example.com/", resp.Header.Get("Location"))
+		require.Empty(t, resp.Header.Values("Set-Cookie"))
+	}
+}
+
+func TestFragmentRedirectsRequireOptIn(t *testing.T) {
+	target := startRedirectTargetServer()
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	err := server.Get("/hello", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/external"))))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+}
+
+func TestNonRedirectStatusesAreNotRedirects(t *testing.T) {
+	target := startRedirectTargetServer()
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	err := server.Get("/hello", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/not-modified", fragment.WithRedirects()))))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.NotEqual(t, http.StatusNotModified, w.Result().StatusCode)
+	require.Empty(t, w.Result().Header.Get("Location"))
+}
+
+func TestIsRedirect(t *testing.T) {
+	for _, status := range []int{301, 302, 303, 307, 308} {
+		require.True(t, isRedirectStatus(status), status)
+	}
+
+	for _, status := range []int{200, 300, 304, 305, 404} {
+		require.False(t, isRedirectStatus(status), status)
+	}
+
+	withLocation := &multiplexer.Result{StatusCode: http.StatusFound, HttpResponse: &http.Response{Header: http.Header{"Location": []string{"/login"}}}}
+	require.True(t, isRedirect(withLocation))
+
+	withoutLocation := &multiplexer.Result{StatusCode: http.StatusFound, HttpResponse: &http.Response{Header: http.Header{}}}
+	require.False(t, isRedirect(withoutLocation))
+}
+
+func TestPublicLocation(t *testing.T) {
+	server := newServer(t, "http://localhost:3000")
+	definition := fragment.Define("/hello")
+
+	r := httptest.NewRequest("GET", "http://viewproxy.example.com/hello", nil)
+	require.Equal(t, "http://viewproxy.example.com/login", server.publicLocation(r, "http://localhost:3000/login", definition))
+	require.Equal(t, "/login", server.publicLocation(r, "/login", definition))
+	require.Equal(t, "https://example.com/login", server.publicLocation(r, "https://example.com/login", definition))
+
+	r.Header.Set("X-Forwarded-Proto", "https")
+	require.Equal(t, "https://viewproxy.example.com/login", server.publicLocation(r, "http://localhost:3000/login", definition))
+}
+
+func TestPublicLocationForBackends(t *testing.T) {
+	server := newServer(t, "http://localhost:3000")
+
+	backend, err := multiplexer.NewBackend("http://search.internal:8080")
+	require.NoError(t, err)
+	server.AddBackend("search", backend)
+
+	r := httptest.NewRequest("GET", "http://viewproxy.example.com/hello", nil)
+
+	searchFragment := fragment.Define("/search", fragment.WithBackend("search"))
+	require.Equal(t, "http://viewproxy.example.com/results", server.publicLocation(r, "http://search.internal:8080/results", searchFragment))
+
+	// Only the redirecting fragment's own backend is rewritten
+	require.Equal(t, "http://search.internal:8080/results", server.publicLocation(r, "http://search.internal:8080/results", fragment.Define("/hello")))
+}
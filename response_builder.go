@@ -3,7 +3,7 @@ package viewproxy
 import (
 	"bytes"
 	"compress/gzip"
-	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -16,6 +16,11 @@ type responseBuilder struct {
 	server     Server
 	body       []byte
 	StatusCode int
+	// used when streaming the response
+	streamWriter  io.Writer
+	gzipWriter    *gzip.Writer
+	startTime     time.Time
+	timingWritten bool
 }
 
 func newResponseBuilder(server Server, w http.ResponseWriter) *responseBuilder {
@@ -55,6 +60,59 @@ func (rb *responseBuilder) Write() {
 	}
 }
 
+// WriteHeader commits the status code and headers and prepares the response
+// to be streamed with WriteChunk.
+func (rb *responseBuilder) WriteHeader() {
+	rb.writer.WriteHeader(rb.StatusCode)
+	rb.streamWriter = rb.writer
+
+	if rb.writer.Header().Get("Content-Encoding") == "gzip" {
+		rb.gzipWriter = gzip.NewWriter(rb.writer)
+		rb.streamWriter = rb.gzipWriter
+	}
+}
+
+// WriteChunk writes part of the body and flushes it to the client.
+func (rb *responseBuilder) WriteChunk(chunk []byte) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+
+	if !rb.timingWritten {
+		timingMarker := []byte("<view-proxy-timing></view-proxy-timing>")
+		if bytes.Contains(chunk, timingMarker) {
+			duration := strconv.FormatInt(time.Since(rb.startTime).Milliseconds(), 10)
+			chunk = bytes.Replace(chunk, timingMarker, []byte(duration), 1)
+			rb.timingWritten = true
+		}
+	}
+
+	if _, err := rb.streamWriter.Write(chunk); err != nil {
+		return err
+	}
+
+	if rb.gzipWriter != nil {
+		if err := rb.gzipWriter.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := rb.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// Close completes a streamed response.
+func (rb *responseBuilder) Close() error {
+	if rb.gzipWriter != nil {
+		return rb.gzipWriter.Close()
+	}
+
+	return nil
+}
+
 func withDefaultErrorHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		results := multiplexer.ResultsFromContext(r.Context())
@@ -73,16 +131,75 @@ func withCombinedFragments(s *Server) http.Handler {
 		route := RouteFromContext(r.Context())
 		results := multiplexer.ResultsFromContext(r.Context())
 
+		if stream := resultStreamFromContext(r.Context()); stream != nil {
+			writeStream(s, rw, r, route, stream)
+			return
+		}
+
 		if results != nil && results.Error() == nil {
 			resBuilder := newResponseBuilder(*s, rw)
+			resultMap := mapResultsToFragmentKey(route, results.Results())
+			stitchStart := time.Now()
 			resBuilder.SetFragments(route, results.Results())
+			stitchDuration := time.Since(stitchStart)
+			if status, ok := route.statusFor(resultMap); ok {
+				resBuilder.StatusCode = status
+			}
 			elapsed := time.Since(startTimeFromContext(r.Context()))
 			resBuilder.SetDuration(elapsed.Milliseconds())
+			if s.serverTimingEnabled(r) {
+				rw.Header().Set("Server-Timing", serverTiming(route, resultMap, stitchDuration, elapsed))
+			}
 			resBuilder.Write()
 		}
 	})
 }
 
+func writeStream(s *Server, rw http.ResponseWriter, r *http.Request, route *Route, stream *resultStream) {
+	resBuilder := newResponseBuilder(*s, rw)
+	resBuilder.startTime = startTimeFromContext(r.Context())
+
+	root := multiplexer.ResultsFromContext(r.Context()).Results()[0]
+	if root.StatusCode != 0 {
+		resBuilder.StatusCode = root.StatusCode
+	}
+	if status, ok := route.statusFor(stream.completed()); ok {
+		resBuilder.StatusCode = status
+	}
+
+	if s.serverTimingEnabled(r) {
+		// Only the fragments that completed before the response started are
+		// included.
+		elapsed := time.Since(resBuilder.startTime)
+		rw.Header().Set("Server-Timing", serverTiming(route, stream.completed(), -1, elapsed))
+	}
+
+	resBuilder.WriteHeader()
+
+	writer := &streamWriter{
+		rb:         resBuilder,
+		stream:     stream,
+		outOfOrder: s.JavaScriptHint != nil && s.JavaScriptHint(r),
+		nonce:      nonceFromCSP(rw.Header().Get("Content-Security-Policy")),
+	}
+
+	err := writer.writeStructure(route.structure)
+	if err == nil {
+		err = writer.writeDeferred()
+	}
+
+	if err != nil {
+		// The status has already been sent, so abort the response to signal
+		// to the client that it is incomplete.
+		s.Logger.Printf("Could not stream response for %s: %s", s.SecretFilter.FilterURL(r.URL), err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := resBuilder.Close(); err != nil {
+		s.Logger.Printf("Could not close gzip writer: %s", err)
+	}
+}
+
 func stitch(structure *stitchStructure, results map[string]*multiplexer.Result) []byte {
 	childContent := make(map[string][]byte)
 
@@ -98,8 +215,7 @@ func stitch(structure *stitchStructure, results map[string]*multiplexer.Result)
 	}
 
 	for replacementKey, content := range childContent {
-		directive := []byte(fmt.Sprintf("<viewproxy-fragment id=\"%s\"></viewproxy-fragment>", replacementKey))
-		self = bytes.Replace(self, directive, content, 1)
+		self = bytes.Replace(self, fragmentDirective(replacementKey), content, 1)
 	}
 
 	return self
@@ -109,6 +225,11 @@ func mapResultsToFragmentKey(route *Route, results []*multiplexer.Result) map[st
 	resultMap := make(map[string]*multiplexer.Result, len(route.FragmentOrder()))
 
 	for i, key := range route.FragmentOrder() {
+		// Only the root result is available when streaming
+		if i >= len(results) {
+			break
+		}
+
 		resultMap[key] = results[i]
 	}
 
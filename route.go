@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
 
 type RouteValidationError struct {
@@ -30,12 +31,34 @@ func (rve *RouteValidationError) Error() string {
 	}
 }
 
+// UnknownBackendError is returned when a route has a fragment using a backend
+// that hasn't been added to the server.
+type UnknownBackendError struct {
+	Route    *Route
+	Fragment *fragment.Definition
+}
+
+func (ube *UnknownBackendError) Error() string {
+	return fmt.Sprintf(
+		"route %s has fragment %s with unknown backend %s",
+		ube.Route.Path,
+		ube.Fragment.Path,
+		ube.Fragment.Backend,
+	)
+}
+
 type Route struct {
 	Path         string
 	Parts        []string
 	dynamicParts []string
 	RootFragment *fragment.Definition
 	Metadata     map[string]string
+	// Non-2xx fragment statuses that are rendered into the page instead of
+	// failing the request, with the page responding with that status.
+	PropagatedStatuses []int
+	// Picks the page status when multiple fragments return a propagated
+	// status. Defaults to OutermostFragmentStatus.
+	StatusPrecedence StatusPrecedence
 	// memoized version of the mapping used to stitch fragments back together
 	structure *stitchStructure
 	// memoized version of fragments to request
@@ -85,6 +108,93 @@ func (r *Route) FragmentsToRequest() []*fragment.Definition {
 	return r.fragmentsToRequest
 }
 
+// propagatesStatus returns true if the given fragment status should be used as
+// the status of the page.
+func (r *Route) propagatesStatus(statusCode int) bool {
+	for _, propagated := range r.PropagatedStatuses {
+		if propagated == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusFor returns the status of the page for the given results, keyed by
+// fragment key, and whether any fragment's status propagated.
+func (r *Route) statusFor(results map[string]*multiplexer.Result) (int, bool) {
+	statuses := make(map[string]int)
+
+	for key, result := range results {
+		if !result.Fallback && r.propagatesStatus(result.StatusCode) {
+			statuses[key] = result.StatusCode
+		}
+	}
+
+	if len(statuses) == 0 {
+		return 0, false
+	}
+
+	if r.StatusPrecedence == nil {
+		return OutermostFragmentStatus(statuses), true
+	}
+
+	return r.StatusPrecedence(statuses), true
+}
+
+// statusKeys returns the keys of the fragments that must complete before a
+// streamed response can start, in fragment order. When the route propagates
+// statuses any fragment can set the page status, so every fragment is waited
+// on.
+func (r *Route) statusKeys() []string {
+	if len(r.PropagatedStatuses) > 0 {
+		return r.FragmentOrder()
+	}
+
+	return r.redirectKeys()
+}
+
+// StatusPrecedence picks the status of the page from the propagated statuses
+// of its fragments, keyed by fragment key.
+type StatusPrecedence func(statuses map[string]int) int
+
+// OutermostFragmentStatus uses the status of the fragment closest to the root,
+// preferring the root fragment itself. Fragments at the same depth are ordered
+// by key.
+func OutermostFragmentStatus(statuses map[string]int) int {
+	var winner string
+
+	for key := range statuses {
+		if winner == "" || outerKey(key, winner) {
+			winner = key
+		}
+	}
+
+	return statuses[winner]
+}
+
+func outerKey(key string, other string) bool {
+	depth, otherDepth := strings.Count(key, "."), strings.Count(other, ".")
+	if depth != otherDepth {
+		return depth < otherDepth
+	}
+
+	return key < other
+}
+
+// HighestStatus uses the highest propagated status, e.g. a 451 over a 404.
+func HighestStatus(statuses map[string]int) int {
+	highest := 0
+
+	for _, status := range statuses {
+		if status > highest {
+			highest = status
+		}
+	}
+
+	return highest
+}
+
 func compareStringSlice(first []string, other []string) bool {
 	sort.Strings(first)
 	sort.Strings(other)
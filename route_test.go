@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	fragment "github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -157,3 +158,26 @@ func TestFragmentMapping(t *testing.T) {
 	require.Equal(t, body, mapping["root.body"])
 	require.Equal(t, root, mapping["root"])
 }
+
+func TestRoute_StatusFor(t *testing.T) {
+	results := map[string]*multiplexer.Result{
+		"root":             {StatusCode: 200},
+		"root.body":        {StatusCode: 404},
+		"root.body.banner": {StatusCode: 451},
+		"root.footer":      {StatusCode: 410, Fallback: true},
+	}
+
+	route := newRoute("/", map[string]string{}, fragment.Define("/"))
+	_, ok := route.statusFor(results)
+	require.False(t, ok)
+
+	WithPropagatedStatuses(404, 410, 451)(route)
+	status, ok := route.statusFor(results)
+	require.True(t, ok)
+	require.Equal(t, 404, status)
+
+	WithStatusPrecedence(HighestStatus)(route)
+	status, ok = route.statusFor(results)
+	require.True(t, ok)
+	require.Equal(t, 451, status)
+}
@@ -0,0 +1,78 @@
+package viewproxy
+
+import "strings"
+
+// routeTree is a segment tree used to match request paths to routes.
+//
+// Each node represents a single path segment. Static segments always take
+// precedence over dynamic (`:param`) segments, regardless of the order routes
+// were registered in. When a static branch fails to match deeper in the tree
+// the dynamic branch is tried instead.
+type routeTree struct {
+	root *routeNode
+}
+
+type routeNode struct {
+	static  map[string]*routeNode
+	dynamic *routeNode
+	route   *Route
+}
+
+func newRouteTree() *routeTree {
+	return &routeTree{root: newRouteNode()}
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{static: make(map[string]*routeNode)}
+}
+
+// insert adds the route to the tree. If a route with identical parts was
+// already added, the first route is kept.
+func (t *routeTree) insert(route *Route) {
+	node := t.root
+
+	for _, part := range route.Parts {
+		if strings.HasPrefix(part, ":") {
+			if node.dynamic == nil {
+				node.dynamic = newRouteNode()
+			}
+			node = node.dynamic
+			continue
+		}
+
+		child, ok := node.static[part]
+		if !ok {
+			child = newRouteNode()
+			node.static[part] = child
+		}
+		node = child
+	}
+
+	if node.route == nil {
+		node.route = route
+	}
+}
+
+// match returns the route matching the given path parts, or nil if no route
+// matches.
+func (t *routeTree) match(parts []string) *Route {
+	return t.root.match(parts)
+}
+
+func (n *routeNode) match(parts []string) *Route {
+	if len(parts) == 0 {
+		return n.route
+	}
+
+	if child, ok := n.static[parts[0]]; ok {
+		if route := child.match(parts[1:]); route != nil {
+			return route
+		}
+	}
+
+	if n.dynamic != nil {
+		return n.dynamic.match(parts[1:])
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package viewproxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchingRoute(t *testing.T) {
+	tests := map[string]struct {
+		routes     []string
+		path       string
+		want       string
+		parameters map[string]string
+	}{
+		"root":                  {routes: []string{"/"}, path: "/", want: "/", parameters: map[string]string{}},
+		"static":                {routes: []string{"/hello/world"}, path: "/hello/world", want: "/hello/world", parameters: map[string]string{}},
+		"dynamic":               {routes: []string{"/hello/:name"}, path: "/hello/world", want: "/hello/:name", parameters: map[string]string{"name": "world"}},
+		"no match":              {routes: []string{"/hello/:name"}, path: "/hello/world/wow"},
+		"static before dynamic": {routes: []string{"/users/:id", "/users/new"}, path: "/users/new", want: "/users/new", parameters: map[string]string{}},
+		"dynamic after static":  {routes: []string{"/users/new", "/users/:id"}, path: "/users/1", want: "/users/:id", parameters: map[string]string{"id": "1"}},
+		"backtracks to dynamic": {
+			routes:     []string{"/users/new/edit", "/users/:id/posts"},
+			path:       "/users/new/posts",
+			want:       "/users/:id/posts",
+			parameters: map[string]string{"id": "new"},
+		},
+		"differently named parameters": {
+			routes:     []string{"/repos/:owner", "/repos/:id/issues"},
+			path:       "/repos/1/issues",
+			want:       "/repos/:id/issues",
+			parameters: map[string]string{"id": "1"},
+		},
+		"first registered wins": {routes: []string{"/hello/:name", "/hello/:login"}, path: "/hello/world", want: "/hello/:name", parameters: map[string]string{"name": "world"}},
+		"trailing slash":        {routes: []string{"/hello/:name"}, path: "/hello/world/", want: "/hello/:name", parameters: map[string]string{"name": "world"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newServer(t, "http://localhost:9999")
+
+			for _, path := range test.routes {
+				err := server.Get(path, fragment.Define(path))
+				require.NoError(t, err)
+			}
+
+			route, parameters := server.MatchingRoute(test.path)
+
+			if test.want == "" {
+				require.Nil(t, route)
+				require.Nil(t, parameters)
+				return
+			}
+
+			require.NotNil(t, route)
+			require.Equal(t, test.want, route.Path)
+			require.Equal(t, test.parameters, parameters)
+		})
+	}
+}
+
+func BenchmarkMatchingRoute(b *testing.B) {
+	server := newServer(b, "http://localhost:9999")
+
+	for i := 0; i < 500; i++ {
+		path := fmt.Sprintf("/section_%d/:name/page_%d", i, i)
+		err := server.Get(path, fragment.Define(path))
+		require.NoError(b, err)
+	}
+
+	path := "/section_499/world/page_499"
+
+	b.Run("tree", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			server.MatchingRoute(path)
+		}
+	})
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearMatchingRoute(server, path)
+		}
+	})
+}
+
+// linearMatchingRoute is the original implementation of MatchingRoute, kept to
+// benchmark against.
+func linearMatchingRoute(s *Server, path string) (*Route, map[string]string) {
+	if s.IgnoreTrailingSlash && path != "/" {
+		path = strings.TrimRight(path, "/")
+	}
+	parts := strings.Split(path, "/")
+
+	for _, route := range s.routes {
+		if route.matchParts(parts) {
+			parameters := route.parametersFor(parts)
+			return &route, parameters
+		}
+	}
+
+	return nil, nil
+}
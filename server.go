@@ -14,13 +14,18 @@ import (
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
+	"github.com/blakewilliams/viewproxy/pkg/signing"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	HeaderViewProxyOriginalPath = "X-Viewproxy-Original-Path"
+	// The cookie clients set to signal they support JavaScript, which is
+	// required to render deferred fragments out of order.
+	JavaScriptHintCookie = "viewproxy_js"
 )
 
 // Re-export ResultError for convenience
@@ -46,11 +51,30 @@ type Server struct {
 	ReadTimeout time.Duration
 	// Sets the maximum duration before timing out writes of the response
 	WriteTimeout time.Duration
+	// Streams the stitched response to the client as fragments complete
+	// instead of waiting for every fragment. The status code and headers are
+	// sent as soon as the root fragment completes, so `AroundResponse` only
+	// has access to the root result. Routes with propagated statuses wait for
+	// every fragment before the response starts. If a fragment fails after the
+	// response has started, the connection is aborted.
+	Streaming bool
+	// Determines if the client supports JavaScript, which is required to
+	// stream deferred fragments out of order. Defaults to checking for the
+	// JavaScriptHintCookie cookie. When it returns false, deferred fragments
+	// are streamed in document order.
+	JavaScriptHint func(*http.Request) bool
+	// Determines if a Server-Timing header listing the duration of each
+	// fragment is added to the response. Defaults to nil, which never adds the
+	// header. See ServerTimingWithHeader to only expose timings to trusted
+	// requests.
+	ServerTiming func(*http.Request) bool
 	// Ignores incoming request's trailing slashes when trying to match a
 	// request URL to a route. This only applies to routes that are not declared
 	// with an explicit trailing slash.
 	IgnoreTrailingSlash bool
 	routes              []Route
+	routeTree           *routeTree
+	backends            map[string]*multiplexer.Backend
 	target              string
 	targetURL           *url.URL
 	httpServer          *http.Server
@@ -66,10 +90,42 @@ type Server struct {
 	// generated at the start of the request, and `X-Authorization`, which is a
 	// hex encoded HMAC of "urlPathWithQueryParams,timestamp`.
 	HmacSecret string
+	// Sets the signer used to sign fragment, layout and route config requests
+	// instead of HmacSecret, e.g. a signer from signing.NewV2Signer that signs
+	// the method and selected headers with a key ID, allowing keys to be
+	// rotated.
+	Signer *signing.Signer
 	// The transport passed to `http.Client` when fetching fragments or proxying
 	// requests.
 	// HttpTransport      http.RoundTripper
 	MultiplexerTripper multiplexer.Tripper
+	// An optional cache of fragment results, shared between requests
+	FragmentCache *multiplexer.Cache
+	// An optional Coalescer that shares fragment requests between concurrent
+	// page requests
+	FragmentCoalescer *multiplexer.Coalescer
+	// An optional RetryPolicy for fragment requests, which fragments can
+	// override with fragment.WithRetries
+	FragmentRetryPolicy *multiplexer.RetryPolicy
+	// An optional Limiter that bounds the number of concurrent fragment
+	// requests to each host
+	FragmentLimiter *multiplexer.Limiter
+	// An optional Hedger that sends a second request for fragments that are
+	// slow to respond
+	FragmentHedger *multiplexer.Hedger
+	// An optional CircuitBreaker that fails fragment requests immediately
+	// while their template URL is failing. State changes are logged.
+	FragmentCircuitBreaker *multiplexer.CircuitBreaker
+	// Builds the response headers from the headers of each fragment. Defaults
+	// to DefaultHeaderMerger.
+	MergeHeaders HeaderMerger
+	// Called with the target's response to pass through requests, allowing it
+	// to be modified before it is sent to the client. Returning an error calls
+	// PassThroughErrorHandler.
+	PassThroughModifyResponse func(*http.Response) error
+	// Called when a pass through request fails. Defaults to logging the error
+	// and responding with a 502.
+	PassThroughErrorHandler func(http.ResponseWriter, *http.Request, error)
 	// A function to wrap the entire request handling with other middleware
 	AroundRequest func(http.Handler) http.Handler
 	// A function to wrap around the generating of the response after the fragment
@@ -82,6 +138,7 @@ type ServerOption = func(*Server) error
 type routeContextKey struct{}
 type parametersContextKey struct{}
 type startTimeKey struct{}
+type fragmentResultsContextKey struct{}
 
 const defaultTimeout = 10 * time.Second
 
@@ -106,10 +163,14 @@ func NewServer(target string, opts ...ServerOption) (*Server, error) {
 		passThrough:         false,
 		AroundRequest:       emptyMiddleware,
 		AroundResponse:      emptyMiddleware,
+		JavaScriptHint:      defaultJavaScriptHint,
+		MergeHeaders:        DefaultHeaderMerger,
 		IgnoreTrailingSlash: true,
 		target:              target,
 		targetURL:           targetURL,
 		routes:              make([]Route, 0),
+		routeTree:           newRouteTree(),
+		backends:            make(map[string]*multiplexer.Backend),
 	}
 
 	for _, fn := range opts {
@@ -132,7 +193,7 @@ func WithPassThrough(passthroughTarget string) ServerOption {
 		}
 
 		server.passThrough = true
-		server.reverseProxy = httputil.NewSingleHostReverseProxy(targetURL)
+		server.reverseProxy = server.newReverseProxy(targetURL)
 
 		return nil
 	}
@@ -150,6 +211,26 @@ func WithRouteMetadata(metadata map[string]string) GetOption {
 	}
 }
 
+// WithPropagatedStatuses renders fragments that respond with one of the given
+// statuses into the page instead of failing the request, and responds with
+// that status. e.g. a fragment that returns a 404 renders the layout with the
+// fragment's not found body and a 404 status. When `Server.Streaming` is
+// enabled, the response waits for every fragment before it starts, since any
+// of them can set the status.
+func WithPropagatedStatuses(statuses ...int) GetOption {
+	return func(route *Route) {
+		route.PropagatedStatuses = append(route.PropagatedStatuses, statuses...)
+	}
+}
+
+// WithStatusPrecedence sets how the page status is picked when multiple
+// fragments return a propagated status.
+func WithStatusPrecedence(precedence StatusPrecedence) GetOption {
+	return func(route *Route) {
+		route.StatusPrecedence = precedence
+	}
+}
+
 func (s *Server) Get(path string, root *fragment.Definition, opts ...GetOption) error {
 	route := newRoute(path, map[string]string{}, root)
 
@@ -162,11 +243,25 @@ func (s *Server) Get(path string, root *fragment.Definition, opts ...GetOption)
 		return err
 	}
 
+	for _, f := range route.FragmentsToRequest() {
+		if _, ok := s.backends[f.Backend]; f.Backend != "" && !ok {
+			return &UnknownBackendError{Route: route, Fragment: f}
+		}
+	}
+
 	s.routes = append(s.routes, *route)
+	s.routeTree.insert(route)
 
 	return nil
 }
 
+// AddBackend registers a backend that fragments can be fetched from via
+// fragment.WithBackend, instead of the server's target. Backends must be added
+// before the routes that use them.
+func (s *Server) AddBackend(name string, backend *multiplexer.Backend) {
+	s.backends[name] = backend
+}
+
 // target returns the configured http target
 func (s *Server) Target() string {
 	return s.target
@@ -185,21 +280,22 @@ func (s *Server) Close() {
 	s.httpServer.Close()
 }
 
-// TODO this should probably be a tree structure for faster lookups
+// MatchingRoute returns the route matching the given path along with the
+// parameters extracted from the path. Static path segments take precedence over
+// dynamic segments, so `/users/new` will match before `/users/:id` regardless
+// of the order the routes were defined in.
 func (s *Server) MatchingRoute(path string) (*Route, map[string]string) {
 	if s.IgnoreTrailingSlash && path != "/" {
 		path = strings.TrimRight(path, "/")
 	}
 	parts := strings.Split(path, "/")
 
-	for _, route := range s.routes {
-		if route.matchParts(parts) {
-			parameters := route.parametersFor(parts)
-			return &route, parameters
-		}
+	route := s.routeTree.match(parts)
+	if route == nil {
+		return nil, nil
 	}
 
-	return nil, nil
+	return route, route.parametersFor(parts)
 }
 
 func (s *Server) rootHandler(next http.Handler) http.Handler {
@@ -215,6 +311,7 @@ func (s *Server) rootHandler(next http.Handler) http.Handler {
 		route, parameters := s.MatchingRoute(r.URL.EscapedPath())
 
 		if route != nil {
+			span.SetAttributes(attribute.String("http.route", route.Path))
 			ctx = context.WithValue(ctx, routeContextKey{}, route)
 			ctx = context.WithValue(ctx, parametersContextKey{}, parameters)
 		}
@@ -246,7 +343,8 @@ func (s *Server) createResponseHandler() http.Handler {
 	handler := withCombinedFragments(s)
 	handler = withDefaultErrorHandler(handler)
 	handler = s.AroundResponse(handler)
-	handler = multiplexer.WithDefaultHeaders(handler)
+	handler = withMergedHeaders(s, handler)
+	handler = withRedirects(s, handler)
 
 	return handler
 }
@@ -255,15 +353,29 @@ func (s *Server) newRequest() *multiplexer.Request {
 	req := multiplexer.NewRequest(s.MultiplexerTripper)
 	req.SecretFilter = s.SecretFilter
 	req.Timeout = s.ProxyTimeout
+	req.Cache = s.FragmentCache
+	req.Coalescer = s.FragmentCoalescer
+	req.RetryPolicy = s.FragmentRetryPolicy
+	req.Limiter = s.FragmentLimiter
+	req.Hedger = s.FragmentHedger
+	req.CircuitBreaker = s.FragmentCircuitBreaker
+	req.OnCircuitStateChange = s.logCircuitStateChange
 	return req
 }
 
+func (s *Server) logCircuitStateChange(transition *multiplexer.CircuitTransition) {
+	s.Logger.Printf("Circuit for %s changed from %s to %s", s.SecretFilter.FilterURLString(transition.TemplateURL), transition.From, transition.To)
+}
+
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, route *Route, parameters map[string]string, ctx context.Context, handler http.Handler) {
 	startTime := time.Now()
 	req := s.newRequest()
 	req.HmacSecret = s.HmacSecret
+	req.Signer = s.Signer
+	req.SpanAttributes = []attribute.KeyValue{attribute.String("http.route", route.Path)}
+	redirectable := make(map[multiplexer.Requestable]bool)
 
-	for _, f := range route.FragmentsToRequest() {
+	for i, f := range route.FragmentsToRequest() {
 		query := url.Values{}
 
 		for name, values := range r.URL.Query() {
@@ -274,8 +386,14 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, route *Ro
 			}
 		}
 
+		target := s.targetURL
+		backend := s.backends[f.Backend]
+		if backend != nil {
+			target = backend.URL
+		}
+
 		dynamicParts := route.dynamicPartsFromRequest(r.URL.EscapedPath())
-		requestable, err := f.Requestable(s.targetURL, dynamicParts, query)
+		requestable, err := f.Requestable(target, dynamicParts, query)
 		if len(r.URL.Query()) > 0 {
 			requestable.RequestURL.RawQuery = query.Encode()
 		}
@@ -284,18 +402,51 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, route *Ro
 			// This can be caused due to invalid encoding
 			panic(err)
 		}
+		requestable.FragmentKey = route.FragmentOrder()[i]
+		requestable.TargetBackend = backend
 		req.WithRequestable(requestable)
+		redirectable[requestable] = f == route.RootFragment || f.Redirects
+	}
+
+	req.AcceptStatus = func(requestable multiplexer.Requestable, statusCode int) bool {
+		if isRedirectStatus(statusCode) && redirectable[requestable] {
+			return true
+		}
+
+		return route.propagatesStatus(statusCode)
 	}
 
 	req.WithHeadersFromRequest(r)
 	req.Header.Set(HeaderViewProxyOriginalPath, r.URL.RequestURI())
-	results, err := req.Do(ctx)
 
 	handlerCtx := context.WithValue(r.Context(), startTimeKey{}, startTime)
-	handlerCtx = multiplexer.ContextWithResults(handlerCtx, results, err)
+
+	if s.Streaming {
+		handlerCtx = s.streamResults(ctx, handlerCtx, route, req)
+	} else {
+		outcomes, err := req.Collect(ctx, nil)
+		results := make([]*multiplexer.Result, 0, len(outcomes))
+
+		if err == nil {
+			for _, outcome := range outcomes {
+				s.logFallback(outcome.Result)
+				results = append(results, outcome.Result)
+			}
+		}
+
+		handlerCtx = multiplexer.ContextWithResults(handlerCtx, results, err)
+		handlerCtx = contextWithFragmentResults(handlerCtx, outcomes)
+	}
+
 	handler.ServeHTTP(w, r.WithContext(handlerCtx))
 }
 
+func (s *Server) logFallback(result *multiplexer.Result) {
+	if result.Fallback {
+		s.Logger.Printf("Rendering fallback for %s: %s", s.SecretFilter.FilterURLString(result.Url), result.FallbackError)
+	}
+}
+
 func (s *Server) handlePassThrough(w http.ResponseWriter, r *http.Request) {
 	if s.passThrough {
 		s.reverseProxy.ServeHTTP(w, r)
@@ -327,6 +478,33 @@ func ParametersFromContext(ctx context.Context) map[string]string {
 	return nil
 }
 
+// FragmentResultsFromContext returns the outcome of each fragment request,
+// keyed by fragment key, e.g. `root.layout.header`. Unlike ResultsFromContext,
+// outcomes are available when the request fails, which allows error pages to
+// show which fragments failed and why.
+//
+// When streaming, only the fragments that completed before the response
+// started are included, unless the request failed.
+func FragmentResultsFromContext(ctx context.Context) map[string]*multiplexer.RequestableResult {
+	if ctx == nil {
+		return nil
+	}
+
+	if results := ctx.Value(fragmentResultsContextKey{}); results != nil {
+		return results.(map[string]*multiplexer.RequestableResult)
+	}
+	return nil
+}
+
+func contextWithFragmentResults(ctx context.Context, outcomes []*multiplexer.RequestableResult) context.Context {
+	results := make(map[string]*multiplexer.RequestableResult, len(outcomes))
+	for _, outcome := range outcomes {
+		results[outcome.Key] = outcome
+	}
+
+	return context.WithValue(ctx, fragmentResultsContextKey{}, results)
+}
+
 func startTimeFromContext(ctx context.Context) time.Time {
 	if ctx == nil {
 		return time.Time{}
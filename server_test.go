@@ -7,6 +7,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,12 +18,17 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/signing"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var targetServer *httptest.Server
@@ -186,6 +192,91 @@ func TestPassThroughDisabled(t *testing.T) {
 	require.Equal(t, "404 not found", string(body))
 }
 
+type recordingTripper struct {
+	requests []*http.Request
+	mu       sync.Mutex
+}
+
+func (t *recordingTripper) Request(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests = append(t.requests, r)
+	t.mu.Unlock()
+
+	return http.DefaultClient.Do(r)
+}
+
+func TestPassThroughUsesMultiplexerTripper(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	viewProxyServer := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
+	tripper := &recordingTripper{}
+	viewProxyServer.MultiplexerTripper = tripper
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	r := httptest.NewRequest("GET", "/oops", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 500, w.Result().StatusCode)
+	require.Len(t, tripper.requests, 1)
+	require.Equal(t, targetServer.URL+"/oops", tripper.requests[0].URL.String())
+	require.Nil(t, multiplexer.RequestableFromContext(tripper.requests[0].Context()))
+	require.True(t, trace.SpanContextFromContext(tripper.requests[0].Context()).IsValid())
+	require.True(t, strings.HasPrefix(tripper.requests[0].Header.Get("traceparent"), "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+}
+
+func TestPassThroughHooks(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
+	viewProxyServer.PassThroughModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusInternalServerError {
+			return errors.New("target failed")
+		}
+
+		resp.Header.Set("X-Modified", "true")
+		return nil
+	}
+
+	var handledErr error
+	viewProxyServer.PassThroughErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handledErr = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	r := httptest.NewRequest("GET", "/not_a_route", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 404, w.Result().StatusCode)
+	require.Equal(t, "true", w.Result().Header.Get("X-Modified"))
+
+	r = httptest.NewRequest("GET", "/oops", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	require.EqualError(t, handledErr, "target failed")
+}
+
+func TestPassThroughDefaultErrorHandler(t *testing.T) {
+	viewProxyServer := newServer(t, "http://localhost:1", WithPassThrough("http://localhost:1"))
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	r := httptest.NewRequest("GET", "/not_a_route", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+}
+
 func TestPassThroughPostRequest(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 	defer cancel()
@@ -258,6 +349,39 @@ func TestFragmentSendsVerifiableHmacWhenSet(t *testing.T) {
 	server.Close()
 }
 
+func TestFragmentSendsVerifiableSignatureWhenSignerSet(t *testing.T) {
+	keys := []signing.Key{{ID: "current", Secret: "6ccd9547b7042e0f1101ce68931d6b2c"}}
+	verifier := signing.NewV2Signer(keys)
+
+	var mu sync.Mutex
+	var verifyErrors []error
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Equal(t, "current", r.Header.Get("X-Authorization-Key-Id"))
+		verifyErrors = append(verifyErrors, verifier.Verify(r))
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	err := viewProxyServer.Get("/hello/:name", fragment.Define("/layout/:name", fragment.WithChild("body", fragment.Define("/foo/:name"))))
+	require.NoError(t, err)
+	viewProxyServer.HmacSecret = "ignored"
+	viewProxyServer.Signer = signing.NewV2Signer(keys, signing.ComponentMethod, signing.ComponentPath)
+
+	r := httptest.NewRequest("GET", "/hello/world?page=2", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, []error{nil, nil}, verifyErrors)
+}
+
 func TestSupportsGzip(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var b bytes.Buffer
@@ -304,6 +428,57 @@ func TestSupportsGzip(t *testing.T) {
 	server.Close()
 }
 
+func TestFragmentBackends(t *testing.T) {
+	secret := "6ccd9547b7042e0f1101ce68931d6b2c"
+
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp := r.Header.Get("X-Authorization-Time")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%s,%s", r.URL.RequestURI(), timestamp)))
+
+		if r.Header.Get("Authorization") != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte("results for " + r.URL.Query().Get("q")))
+	}))
+	defer search.Close()
+
+	backend, err := multiplexer.NewBackend(search.URL)
+	require.NoError(t, err)
+	backend.HmacSecret = secret
+	tripper := &recordingTripper{}
+	backend.Tripper = tripper
+
+	server := newServer(t, targetServer.URL)
+	server.AddBackend("search", backend)
+
+	root := fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/search/:name", fragment.WithBackend("search"))),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	err = server.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world?q=viewproxy", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "<html><body>results for viewproxy</body></html>", w.Body.String())
+	require.Len(t, tripper.requests, 1)
+	require.Equal(t, search.URL+"/search/world?q=viewproxy", tripper.requests[0].URL.String())
+
+	err = server.Get("/goodbye/:name", fragment.Define("/search/:name", fragment.WithBackend("missing")))
+	var backendErr *UnknownBackendError
+	require.ErrorAs(t, err, &backendErr)
+	require.Equal(t, "missing", backendErr.Fragment.Backend)
+}
+
 func TestAroundRequestCallback(t *testing.T) {
 	done := make(chan struct{})
 
@@ -390,6 +565,124 @@ func TestErrorHandler(t *testing.T) {
 	}
 }
 
+func TestOptionalFragmentRendersFallback(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	root := fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/missing/:name", fragment.WithFallback("fallback body"))),
+		fragment.WithChild("footer", fragment.Define("/missing_footer/:name", fragment.Optional())),
+	)
+	err := server.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	var fallbacks []string
+	server.AroundResponse = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			for _, result := range multiplexer.ResultsFromContext(r.Context()).Results() {
+				if result.Fallback {
+					fallbacks = append(fallbacks, result.Url)
+				}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "<html><body>fallback body</html>", string(body))
+	require.ElementsMatch(t, []string{
+		fmt.Sprintf("%s/missing/world", targetServer.URL),
+		fmt.Sprintf("%s/missing_footer/world", targetServer.URL),
+	}, fallbacks)
+}
+
+func TestPropagatesFragmentStatus(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+
+	root := fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/missing/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	err := server.Get("/hello/:name", root, WithPropagatedStatuses(http.StatusNotFound, http.StatusGone))
+	require.NoError(t, err)
+	err = server.Get("/goodbye/:name", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "<html><body>target: 404 not found</body></html>", string(body))
+
+	r = httptest.NewRequest("GET", "/goodbye/world", nil)
+	w = httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+}
+
+func TestInjectsTraceContext(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	var mu sync.Mutex
+	traceparents := make(map[string]string)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents[r.URL.Path] = r.Header.Get("traceparent")
+		mu.Unlock()
+
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL, WithPassThrough(target.URL))
+	err := server.Get("/hello", fragment.Define("/layout"))
+	require.NoError(t, err)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	for _, path := range []string{"/hello", "/passthrough"} {
+		r := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		server.CreateHandler().ServeHTTP(w, r)
+		require.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	for _, path := range []string{"/layout", "/passthrough"} {
+		traceparent := traceparents[path]
+		require.True(t, strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"), "unexpected traceparent for %s: %s", path, traceparent)
+	}
+}
+
 type contextTestTripper struct {
 	route        *Route
 	requestables []multiplexer.Requestable
@@ -552,3 +845,98 @@ func newServer(tb testing.TB, target string, opts ...ServerOption) *Server {
 
 	return server
 }
+
+func TestFragmentCircuitBreaker(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/layout") {
+			w.Write([]byte(`<body><viewproxy-fragment id="sidebar"></viewproxy-fragment></body>`))
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.Logger = log.New(&logs, "", 0)
+	viewProxyServer.FragmentCircuitBreaker = multiplexer.NewCircuitBreaker(1, time.Minute)
+	err := viewProxyServer.Get(
+		"/hello/:name",
+		fragment.Define("/layout/:name", fragment.WithChild("sidebar", fragment.Define("/sidebar/:name", fragment.WithFallback("unavailable")))),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/hello/world", nil)
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "<body>unavailable</body>", w.Body.String())
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	require.Contains(t, logs.String(), "Circuit for "+server.URL+"/sidebar/:name changed from closed to open")
+}
+
+func TestFragmentResultsFromContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<body><viewproxy-fragment id="broken"></viewproxy-fragment><viewproxy-fragment id="slow"></viewproxy-fragment></body>`))
+		case "/broken":
+			// Fail after the layout has completed
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", 0)
+
+	var fragmentResults map[string]*multiplexer.RequestableResult
+	viewProxyServer.AroundResponse = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fragmentResults = FragmentResultsFromContext(r.Context())
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	err := viewProxyServer.Get(
+		"/hello",
+		fragment.Define(
+			"/layout",
+			fragment.WithChild("broken", fragment.Define("/broken")),
+			fragment.WithChild("slow", fragment.Define("/slow")),
+		),
+	)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 500, w.Result().StatusCode)
+	require.Len(t, fragmentResults, 3)
+
+	require.NoError(t, fragmentResults["root"].Err)
+	require.Equal(t, 200, fragmentResults["root"].Result.StatusCode)
+
+	var resultErr *multiplexer.ResultError
+	require.ErrorAs(t, fragmentResults["root.broken"].Err, &resultErr)
+	require.Equal(t, 500, resultErr.Result.StatusCode)
+	require.False(t, fragmentResults["root.broken"].Cancelled)
+
+	require.True(t, fragmentResults["root.slow"].Cancelled)
+	require.Nil(t, fragmentResults["root.slow"].Result)
+	require.Equal(t, "root.slow", fragmentResults["root.slow"].Key)
+}
@@ -0,0 +1,74 @@
+package viewproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// ServerTimingWithHeader returns a function for Server.ServerTiming that only
+// adds the Server-Timing header to requests sending the given header and value,
+// e.g. a secret shared with developers.
+func ServerTimingWithHeader(name string, value string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(name)), []byte(value)) == 1
+	}
+}
+
+func (s *Server) serverTimingEnabled(r *http.Request) bool {
+	return s.ServerTiming != nil && s.ServerTiming(r)
+}
+
+// serverTiming returns a Server-Timing header value containing the duration of
+// each fragment in fragment order, followed by the stitch and total duration.
+// A negative stitch duration is omitted.
+func serverTiming(route *Route, results map[string]*multiplexer.Result, stitch time.Duration, total time.Duration) string {
+	metrics := make([]string, 0, len(results)+2)
+
+	for _, key := range route.FragmentOrder() {
+		result, ok := results[key]
+		if !ok {
+			continue
+		}
+
+		metric := serverTimingMetric(serverTimingName(key), result.Duration)
+
+		if result.Fallback {
+			metric += `;desc="fallback"`
+		} else if result.Stale {
+			metric += `;desc="stale"`
+		} else if result.CacheHit {
+			metric += `;desc="cache hit"`
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	if stitch >= 0 {
+		metrics = append(metrics, serverTimingMetric("stitch", stitch))
+	}
+
+	metrics = append(metrics, serverTimingMetric("total", total))
+
+	return strings.Join(metrics, ", ")
+}
+
+func serverTimingMetric(name string, duration time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.2f", name, float64(duration)/float64(time.Millisecond))
+}
+
+// serverTimingName replaces characters that aren't valid in a metric name,
+// which must be an HTTP token.
+func serverTimingName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r) {
+			return r
+		}
+
+		return '_'
+	}, key)
+}
@@ -0,0 +1,68 @@
+package viewproxy
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTimingHeader(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.ServerTiming = ServerTimingWithHeader("X-Viewproxy-Timing", "secret")
+
+	root := fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	err := server.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Empty(t, w.Result().Header.Get("Server-Timing"))
+
+	r = httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("X-Viewproxy-Timing", "secret")
+	w = httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Regexp(
+		t,
+		regexp.MustCompile(`^root;dur=\d+\.\d{2}, root\.body;dur=\d+\.\d{2}, root\.footer;dur=\d+\.\d{2}, root\.header;dur=\d+\.\d{2}, stitch;dur=\d+\.\d{2}, total;dur=\d+\.\d{2}$`),
+		w.Result().Header.Get("Server-Timing"),
+	)
+}
+
+func TestServerTiming(t *testing.T) {
+	root := fragment.Define("/layout", fragment.WithChild("side bar", fragment.Define("/sidebar")))
+	route := newRoute("/", map[string]string{}, root)
+
+	results := map[string]*multiplexer.Result{
+		"root":          {Duration: 12500 * time.Microsecond},
+		"root.side bar": {Fallback: true},
+	}
+
+	require.Equal(
+		t,
+		`root;dur=12.50, root.side_bar;dur=0.00;desc="fallback", stitch;dur=0.25, total;dur=15.00`,
+		serverTiming(route, results, 250*time.Microsecond, 15*time.Millisecond),
+	)
+	require.Equal(
+		t,
+		`root;dur=12.50, total;dur=15.00`,
+		serverTiming(route, map[string]*multiplexer.Result{"root": results["root"]}, -1, 15*time.Millisecond),
+	)
+}
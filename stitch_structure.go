@@ -5,6 +5,7 @@ import "github.com/blakewilliams/viewproxy/pkg/fragment"
 type stitchStructure struct {
 	key                 string
 	replacementID       string
+	deferred            bool
 	dependentStructures []*stitchStructure
 }
 
@@ -16,6 +17,12 @@ func (s *stitchStructure) ReplacementID() string {
 	return s.replacementID
 }
 
+// Deferred returns true when the fragment can be streamed after the rest of the
+// document.
+func (s *stitchStructure) Deferred() bool {
+	return s.deferred
+}
+
 func (s *stitchStructure) DependentStructures() []*stitchStructure {
 	return s.dependentStructures
 }
@@ -32,7 +39,7 @@ func stitchStructureFor(d *fragment.Definition) *stitchStructure {
 
 func childStitchStructure(prefix string, name string, d *fragment.Definition) *stitchStructure {
 	key := prefix + "." + name
-	buildInfo := &stitchStructure{key: key, replacementID: name}
+	buildInfo := &stitchStructure{key: key, replacementID: name, deferred: d.Deferred}
 
 	for name, child := range d.Children() {
 		buildInfo.dependentStructures = append(buildInfo.dependentStructures, childStitchStructure(key, name, child))
@@ -0,0 +1,388 @@
+package viewproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+type resultStreamKey struct{}
+
+// resultStream collects fragment results as they complete so that a response
+// can be written before every fragment has finished.
+type resultStream struct {
+	keys     []string
+	ready    map[string]chan struct{}
+	results  map[string]*multiplexer.Result
+	outcomes []*multiplexer.RequestableResult
+	done     chan struct{}
+	err      error
+	mu       sync.Mutex
+}
+
+func newResultStream(keys []string) *resultStream {
+	ready := make(map[string]chan struct{}, len(keys))
+	for _, key := range keys {
+		ready[key] = make(chan struct{})
+	}
+
+	return &resultStream{
+		keys:    keys,
+		ready:   ready,
+		results: make(map[string]*multiplexer.Result, len(keys)),
+		done:    make(chan struct{}),
+	}
+}
+
+// add stores the outcome of the fragment at its index in the route's fragment
+// order, and unblocks anyone waiting on its result.
+func (rs *resultStream) add(outcome *multiplexer.RequestableResult) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.outcomes = append(rs.outcomes, outcome)
+	if outcome.Err != nil {
+		return
+	}
+
+	key := rs.keys[outcome.Index]
+	if _, ok := rs.results[key]; ok {
+		return
+	}
+
+	rs.results[key] = outcome.Result
+	close(rs.ready[key])
+}
+
+// finish is called once all results are available, or the request failed,
+// with the outcome of every fragment.
+func (rs *resultStream) finish(outcomes []*multiplexer.RequestableResult, err error) {
+	rs.mu.Lock()
+	rs.outcomes = outcomes
+	rs.err = err
+	rs.mu.Unlock()
+	close(rs.done)
+}
+
+// wait blocks until the result for the given fragment key is available, or
+// returns the error that prevented it from completing.
+func (rs *resultStream) wait(key string) (*multiplexer.Result, error) {
+	select {
+	case <-rs.ready[key]:
+	case <-rs.done:
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if result, ok := rs.results[key]; ok {
+		return result, nil
+	}
+
+	if rs.err != nil {
+		return nil, rs.err
+	}
+
+	return nil, fmt.Errorf("no result for fragment %s", key)
+}
+
+// completed returns the results that are available so far, keyed by fragment
+// key.
+func (rs *resultStream) completed() map[string]*multiplexer.Result {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	results := make(map[string]*multiplexer.Result, len(rs.results))
+	for key, result := range rs.results {
+		results[key] = result
+	}
+
+	return results
+}
+
+// completedOutcomes returns the outcomes of the fragments that have completed so
+// far, or of every fragment once the stream is finished.
+func (rs *resultStream) completedOutcomes() []*multiplexer.RequestableResult {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	outcomes := make([]*multiplexer.RequestableResult, len(rs.outcomes))
+	copy(outcomes, rs.outcomes)
+
+	return outcomes
+}
+
+func resultStreamFromContext(ctx context.Context) *resultStream {
+	if ctx == nil {
+		return nil
+	}
+
+	if stream := ctx.Value(resultStreamKey{}); stream != nil {
+		return stream.(*resultStream)
+	}
+	return nil
+}
+
+// streamResults starts the fragment requests in the background and waits for
+// the root fragment, along with any fragments that can redirect or propagate
+// their status. The returned context contains the root result, or the
+// error that prevented it from completing, the outcomes of the fragments that
+// have completed, and the stream used to write the remaining fragments.
+func (s *Server) streamResults(ctx context.Context, handlerCtx context.Context, route *Route, req *multiplexer.Request) context.Context {
+	stream := newResultStream(route.FragmentOrder())
+
+	go func() {
+		outcomes, err := req.Collect(ctx, func(outcome *multiplexer.RequestableResult) {
+			if outcome.Err == nil {
+				s.logFallback(outcome.Result)
+			}
+			stream.add(outcome)
+		})
+		stream.finish(outcomes, err)
+	}()
+
+	for _, key := range route.statusKeys() {
+		if _, err := stream.wait(key); err != nil {
+			handlerCtx = contextWithFragmentResults(handlerCtx, stream.completedOutcomes())
+			return multiplexer.ContextWithResults(handlerCtx, make([]*multiplexer.Result, 0), err)
+		}
+	}
+
+	root, _ := stream.wait("root")
+
+	handlerCtx = contextWithFragmentResults(handlerCtx, stream.completedOutcomes())
+	handlerCtx = multiplexer.ContextWithResults(handlerCtx, []*multiplexer.Result{root}, nil)
+	return context.WithValue(handlerCtx, resultStreamKey{}, stream)
+}
+
+// streamWriter writes fragments to a response as they complete.
+type streamWriter struct {
+	rb     *responseBuilder
+	stream *resultStream
+	// when true, deferred fragments are written after the rest of the
+	// document instead of in document order
+	outOfOrder  bool
+	deferred    []*stitchStructure
+	nonce       string
+	swapWritten bool
+	// the closing tags of the document, held back until the deferred
+	// fragments are written so that they stay inside the document
+	tail []byte
+}
+
+// writeStructure writes the given fragment in document order, waiting on each
+// child fragment as its placeholder is reached.
+func (sw *streamWriter) writeStructure(structure *stitchStructure) error {
+	result, err := sw.stream.wait(structure.Key())
+	if err != nil {
+		return err
+	}
+
+	body := result.Body
+	offset := 0
+
+	for _, placeholder := range placeholdersFor(body, structure.DependentStructures()) {
+		if err := sw.rb.WriteChunk(body[offset:placeholder.start]); err != nil {
+			return err
+		}
+
+		if sw.outOfOrder && placeholder.structure.Deferred() {
+			// Keep a placeholder with a unique id for the client to swap the
+			// fragment into once it is written.
+			sw.deferred = append(sw.deferred, placeholder.structure)
+			err = sw.rb.WriteChunk(fragmentDirective(placeholder.structure.Key()))
+		} else {
+			err = sw.writeStructure(placeholder.structure)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		offset = placeholder.end
+	}
+
+	rest := body[offset:]
+	if structure.Key() == "root" && len(sw.deferred) > 0 {
+		end := closingTagIndex(rest)
+		sw.tail = rest[end:]
+		rest = rest[:end]
+	}
+
+	return sw.rb.WriteChunk(rest)
+}
+
+var (
+	closingBodyRegexp = regexp.MustCompile(`(?i)</body\s*>`)
+	closingHTMLRegexp = regexp.MustCompile(`(?i)</html\s*>`)
+)
+
+// closingTagIndex returns the index of the document's closing `</body>` tag,
+// or `</html>` when there is no body tag, or the length of body when there is
+// neither.
+func closingTagIndex(body []byte) int {
+	if match := closingBodyRegexp.FindIndex(body); match != nil {
+		return match[0]
+	}
+
+	if match := closingHTMLRegexp.FindIndex(body); match != nil {
+		return match[0]
+	}
+
+	return len(body)
+}
+
+type deferredResult struct {
+	structure *stitchStructure
+	content   []byte
+	err       error
+}
+
+// writeDeferred writes each deferred fragment in the order they complete,
+// wrapped in a template along with a script that swaps it into its
+// placeholder, followed by the closing tags held back by writeStructure.
+func (sw *streamWriter) writeDeferred() error {
+	completed := make(chan deferredResult, len(sw.deferred))
+
+	for _, structure := range sw.deferred {
+		go func(structure *stitchStructure) {
+			results, err := sw.waitAll(structure, make(map[string]*multiplexer.Result))
+			if err != nil {
+				completed <- deferredResult{structure: structure, err: err}
+				return
+			}
+
+			completed <- deferredResult{structure: structure, content: stitch(structure, results)}
+		}(structure)
+	}
+
+	for range sw.deferred {
+		deferred := <-completed
+		if deferred.err != nil {
+			return deferred.err
+		}
+
+		if err := sw.writeSwap(deferred.structure.Key(), deferred.content); err != nil {
+			return err
+		}
+	}
+
+	return sw.rb.WriteChunk(sw.tail)
+}
+
+// waitAll waits for the results of the given fragment and all of its children.
+func (sw *streamWriter) waitAll(structure *stitchStructure, results map[string]*multiplexer.Result) (map[string]*multiplexer.Result, error) {
+	result, err := sw.stream.wait(structure.Key())
+	if err != nil {
+		return nil, err
+	}
+	results[structure.Key()] = result
+
+	for _, child := range structure.DependentStructures() {
+		if _, err := sw.waitAll(child, results); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+const swapScript = `function viewproxySwap(id){` +
+	`var t=document.getElementById("viewproxy-template-"+id),` +
+	`p=document.querySelector('viewproxy-fragment[id="'+id+'"]');` +
+	`if(t&&p){p.replaceWith(t.content);t.remove()}}`
+
+func (sw *streamWriter) writeSwap(key string, content []byte) error {
+	var chunk bytes.Buffer
+
+	if !sw.swapWritten {
+		chunk.WriteString(sw.scriptTag(swapScript))
+		sw.swapWritten = true
+	}
+
+	jsKey, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&chunk, `<template id="viewproxy-template-%s">`, html.EscapeString(key))
+	chunk.Write(content)
+	chunk.WriteString("</template>")
+	chunk.WriteString(sw.scriptTag(fmt.Sprintf("viewproxySwap(%s)", jsKey)))
+
+	return sw.rb.WriteChunk(chunk.Bytes())
+}
+
+func (sw *streamWriter) scriptTag(script string) string {
+	if sw.nonce == "" {
+		return fmt.Sprintf("<script>%s</script>", script)
+	}
+
+	return fmt.Sprintf(`<script nonce="%s">%s</script>`, html.EscapeString(sw.nonce), script)
+}
+
+var cspNonceRegexp = regexp.MustCompile(`'nonce-([^']+)'`)
+
+// nonceFromCSP returns the nonce from a Content-Security-Policy header so that
+// inline scripts are allowed to run, or an empty string if there is none.
+func nonceFromCSP(policy string) string {
+	matches := cspNonceRegexp.FindStringSubmatch(policy)
+	if matches == nil {
+		return ""
+	}
+
+	return matches[1]
+}
+
+// defaultJavaScriptHint checks for the cookie set by the client to signal that
+// it supports JavaScript.
+func defaultJavaScriptHint(r *http.Request) bool {
+	_, err := r.Cookie(JavaScriptHintCookie)
+	return err == nil
+}
+
+type placeholder struct {
+	structure *stitchStructure
+	start     int
+	end       int
+}
+
+// placeholdersFor returns the `<viewproxy-fragment>` placeholders of the given
+// child structures in the order they appear in body. Children without a
+// placeholder are omitted.
+func placeholdersFor(body []byte, structures []*stitchStructure) []placeholder {
+	placeholders := make([]placeholder, 0, len(structures))
+
+	for _, structure := range structures {
+		directive := fragmentDirective(structure.ReplacementID())
+		start := bytes.Index(body, directive)
+
+		if start == -1 {
+			continue
+		}
+
+		placeholders = append(placeholders, placeholder{
+			structure: structure,
+			start:     start,
+			end:       start + len(directive),
+		})
+	}
+
+	sort.Slice(placeholders, func(i, j int) bool {
+		return placeholders[i].start < placeholders[j].start
+	})
+
+	return placeholders
+}
+
+func fragmentDirective(replacementID string) []byte {
+	return []byte(fmt.Sprintf("<viewproxy-fragment id=\"%s\"></viewproxy-fragment>", replacementID))
+}
@@ -0,0 +1,268 @@
+package viewproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamingFlushesFragmentsInDocumentOrder(t *testing.T) {
+	release := make(chan struct{})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Set("X-Layout", "true")
+			w.Write([]byte(`<html><viewproxy-fragment id="header"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/header":
+			w.Write([]byte("<header></header>"))
+		case "/body":
+			<-release
+			w.Write([]byte(`<main><viewproxy-fragment id="content"></viewproxy-fragment></main>`))
+		case "/content":
+			w.Write([]byte("content"))
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	server.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	server.Streaming = true
+	err := server.Get("/", fragment.Define("/layout", fragment.WithChildren(fragment.Children{
+		"header": fragment.Define("/header"),
+		"body":   fragment.Define("/body", fragment.WithChild("content", fragment.Define("/content"))),
+	})))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(server.CreateHandler())
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "true", resp.Header.Get("X-Layout"))
+
+	prefix := "<html><header></header>"
+	buf := make([]byte, len(prefix))
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	require.Equal(t, prefix, string(buf))
+
+	close(release)
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "<main>content</main></html>", string(rest))
+}
+
+func TestStreamingGzip(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzWriter := gzip.NewWriter(w)
+		defer gzWriter.Close()
+
+		if strings.HasPrefix(r.URL.Path, "/layout") {
+			gzWriter.Write([]byte(`<body><viewproxy-fragment id="fragment"></viewproxy-fragment></body>`))
+		} else {
+			gzWriter.Write([]byte("wow gzipped!"))
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	server.Streaming = true
+	err := server.Get(
+		"/hello/:name",
+		fragment.Define("/layout/:name", fragment.WithChild("fragment", fragment.Define("/fragment/:name"))),
+	)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	require.True(t, w.Flushed)
+
+	gzReader, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadAll(gzReader)
+	require.NoError(t, err)
+	require.Equal(t, "<body>wow gzipped!</body>", string(body))
+}
+
+func TestStreamingRootError(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.Streaming = true
+	err := server.Get("/hello/:name", fragment.Define("/definitely_missing/:name"))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 500, w.Code)
+	require.Equal(t, "500 internal server error", w.Body.String())
+}
+
+func TestStreamingAbortsOnFragmentError(t *testing.T) {
+	rootWritten := make(chan struct{})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			defer close(rootWritten)
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/body":
+			// give viewproxy time to start streaming the root fragment
+			<-rootWritten
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	server.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	server.Streaming = true
+	err := server.Get("/", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body"))))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(server.CreateHandler())
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, 200, resp.StatusCode)
+	_, err = ioutil.ReadAll(resp.Body)
+	require.Error(t, err)
+}
+
+func TestStreamingPropagatesFragmentStatus(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.Streaming = true
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/missing/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	), WithPropagatedStatuses(http.StatusNotFound))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "<html><body>target: 404 not found</body></html>", w.Body.String())
+}
+
+func TestStreamingDeferredFragments(t *testing.T) {
+	release := make(chan struct{})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Set("Content-Security-Policy", "script-src 'self' 'nonce-abc123'")
+			w.Write([]byte(`<html><body><viewproxy-fragment id="sidebar"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment></body></html>`))
+		case "/sidebar":
+			<-release
+			w.Write([]byte(`<aside><viewproxy-fragment id="ad"></viewproxy-fragment></aside>`))
+		case "/ad":
+			w.Write([]byte("ad"))
+		case "/body":
+			w.Write([]byte("<main></main>"))
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	server.Streaming = true
+	err := server.Get("/", fragment.Define("/layout", fragment.WithChildren(fragment.Children{
+		"sidebar": fragment.Define("/sidebar", fragment.Deferred(), fragment.WithChild("ad", fragment.Define("/ad"))),
+		"body":    fragment.Define("/body"),
+	})))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(server.CreateHandler())
+	defer proxy.Close()
+
+	req, err := http.NewRequest("GET", proxy.URL, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: JavaScriptHintCookie, Value: "1"})
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The closing tags are held back so the deferred fragments stay inside
+	// the document
+	document := `<html><body><viewproxy-fragment id="root.sidebar"></viewproxy-fragment><main></main>`
+	buf := make([]byte, len(document))
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	require.Equal(t, document, string(buf))
+
+	close(release)
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		`<script nonce="abc123">`+swapScript+`</script>`+
+			`<template id="viewproxy-template-root.sidebar"><aside>ad</aside></template>`+
+			`<script nonce="abc123">viewproxySwap("root.sidebar")</script>`+
+			`</body></html>`,
+		string(rest),
+	)
+}
+
+func TestStreamingDeferredFragmentsWithoutJavaScript(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.Streaming = true
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name", fragment.Deferred())),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "<html><body>hello world</body></html>", w.Body.String())
+}
+
+func TestClosingTagIndex(t *testing.T) {
+	require.Equal(t, 6, closingTagIndex([]byte("</div></body></html>")))
+	require.Equal(t, 6, closingTagIndex([]byte("</div></BODY ></html>")))
+	require.Equal(t, 6, closingTagIndex([]byte("</div></html>")))
+	require.Equal(t, 6, closingTagIndex([]byte("</div>")))
+}
+
+func TestNonceFromCSP(t *testing.T) {
+	require.Equal(t, "", nonceFromCSP(""))
+	require.Equal(t, "", nonceFromCSP("default-src 'self'"))
+	require.Equal(t, "r4nd0m", nonceFromCSP("default-src 'self'; script-src 'nonce-r4nd0m' 'strict-dynamic'"))
+}